@@ -0,0 +1,155 @@
+//Package auth signs the requests nodes send to servers with HMAC, using a secret each node is given
+//when it enrolls with a server, and verifies those signatures on the server
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//The http-headers a signed request carries
+const (
+	HeaderNode      = "X-Autobd-Node"      //UUID of the node that signed the request
+	HeaderTimestamp = "X-Autobd-Timestamp" //When the request was signed, in seconds since the epoch
+	HeaderNonce     = "X-Autobd-Nonce"     //Random value that's never signed twice
+	HeaderSignature = "X-Autobd-Signature" //HMAC-SHA256 of the request, hex encoded
+)
+
+func randomHex(size int) (string, error) {
+	buffer := make([]byte, size)
+	if _, err := rand.Read(buffer); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buffer), nil
+}
+
+//NewSecret returns a new random secret for a node
+func NewSecret() (string, error) {
+	return randomHex(32)
+}
+
+//canonical returns the parts of request that are signed, one per line: the method, path, query
+//with its keys sorted, the SHA256 of the body, the timestamp and the nonce
+func canonical(request *http.Request, body []byte, timestamp string, nonce string) []byte {
+	bodyHash := sha256.Sum256(body)
+	return []byte(strings.Join([]string{
+		request.Method,
+		request.URL.Path,
+		request.URL.Query().Encode(),
+		hex.EncodeToString(bodyHash[:]),
+		timestamp,
+		nonce,
+	}, "\n"))
+}
+
+func signature(secret string, message []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(message)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//readBody reads the body of request, and replaces it so it can be read again
+func readBody(request *http.Request) ([]byte, error) {
+	if request.Body == nil {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(request.Body)
+	request.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+//Sign signs request as the node with uuid, using the node's secret
+func Sign(request *http.Request, uuid string, secret string) error {
+	body, err := readBody(request)
+	if err != nil {
+		return err
+	}
+	nonce, err := randomHex(16)
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.Header.Set(HeaderNode, uuid)
+	request.Header.Set(HeaderTimestamp, timestamp)
+	request.Header.Set(HeaderNonce, nonce)
+	request.Header.Set(HeaderSignature, signature(secret, canonical(request, body, timestamp, nonce)))
+	return nil
+}
+
+//Nonces seen in the last maxAge, with when they expire, so a signed request can't be replayed
+var nonces = make(map[string]time.Time)
+var lastPruned time.Time
+
+//For synchronized access to nonces
+var nonceLock = sync.Mutex{}
+
+//useNonce records nonce, and returns false if it was already used
+func useNonce(nonce string, now time.Time, maxAge time.Duration) bool {
+	nonceLock.Lock()
+	defer nonceLock.Unlock()
+	if now.Sub(lastPruned) > maxAge {
+		for seen, expires := range nonces {
+			if now.After(expires) {
+				delete(nonces, seen)
+			}
+		}
+		lastPruned = now
+	}
+	if _, seen := nonces[nonce]; seen == true {
+		return false
+	}
+	//A request is accepted for maxAge either side of its timestamp, so that's how long the nonce
+	//needs to be remembered for
+	nonces[nonce] = now.Add(2 * maxAge)
+	return true
+}
+
+//Verify checks that request, whose body has already been read into body, was signed with secret
+//no more than maxAge ago, and that its signature wasn't used before
+func Verify(request *http.Request, body []byte, secret string, maxAge time.Duration) error {
+	timestamp := request.Header.Get(HeaderTimestamp)
+	nonce := request.Header.Get(HeaderNonce)
+	given, err := hex.DecodeString(request.Header.Get(HeaderSignature))
+	if err != nil || len(given) == 0 || timestamp == "" || nonce == "" {
+		return fmt.Errorf("Request is not signed")
+	}
+	expected, _ := hex.DecodeString(signature(secret, canonical(request, body, timestamp, nonce)))
+	if hmac.Equal(given, expected) == false {
+		return fmt.Errorf("Invalid signature")
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid signature timestamp")
+	}
+	now := time.Now()
+	if age := now.Sub(time.Unix(seconds, 0)); age > maxAge || age < -maxAge {
+		return fmt.Errorf("Signature is too old, or the clocks of the node and server differ by more than %s", maxAge)
+	}
+	if useNonce(nonce, now, maxAge) == false {
+		return fmt.Errorf("Signature was already used")
+	}
+	return nil
+}
+
+//VerifyRequest is Verify, reading the body from request. The body is replaced so handlers can still read it
+func VerifyRequest(request *http.Request, secret string, maxAge time.Duration) error {
+	body, err := readBody(request)
+	if err != nil {
+		return err
+	}
+	return Verify(request, body, secret, maxAge)
+}
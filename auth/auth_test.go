@@ -0,0 +1,78 @@
+package auth_test
+
+import (
+	"bytes"
+	"github.com/tywkeene/autobd/auth"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const uuid = "a468d5d0-56b8-4b0d-be2f-08b7d612b055"
+
+func signedRequest(t *testing.T, secret string, body string) *http.Request {
+	request, err := http.NewRequest("POST", "http://localhost:8080/v0/batch?uuid="+uuid+"&dir=./", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.Sign(request, uuid, secret); err != nil {
+		t.Fatal(err)
+	}
+	return request
+}
+
+func TestVerify(t *testing.T) {
+	secret, err := auth.NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := signedRequest(t, secret, `["a", "b"]`)
+	if request.Header.Get(auth.HeaderNode) != uuid {
+		t.Errorf("Signed by %s, expected %s", request.Header.Get(auth.HeaderNode), uuid)
+	}
+	if err := auth.VerifyRequest(request, secret, time.Minute); err != nil {
+		t.Errorf("Valid signature refused: %s", err.Error())
+	}
+	//The signature can't be used a second time
+	if err := auth.VerifyRequest(request, secret, time.Minute); err == nil {
+		t.Errorf("Replayed signature accepted")
+	}
+
+	var table = []struct {
+		Name   string
+		Tamper func(request *http.Request) []byte
+	}{
+		{"body", func(request *http.Request) []byte {
+			return []byte(`["a", "../b"]`)
+		}},
+		{"query", func(request *http.Request) []byte {
+			request.URL.RawQuery = "uuid=" + uuid + "&dir=../"
+			return []byte(`["a", "b"]`)
+		}},
+		{"method", func(request *http.Request) []byte {
+			request.Method = "GET"
+			return []byte(`["a", "b"]`)
+		}},
+		{"stale", func(request *http.Request) []byte {
+			request.Header.Set(auth.HeaderTimestamp, strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10))
+			return []byte(`["a", "b"]`)
+		}},
+		{"unsigned", func(request *http.Request) []byte {
+			request.Header.Del(auth.HeaderSignature)
+			return []byte(`["a", "b"]`)
+		}},
+	}
+	for _, test := range table {
+		request := signedRequest(t, secret, `["a", "b"]`)
+		body := test.Tamper(request)
+		if err := auth.Verify(request, body, secret, time.Minute); err == nil {
+			t.Errorf("%s: tampered request accepted", test.Name)
+		}
+	}
+
+	other, _ := auth.NewSecret()
+	if err := auth.VerifyRequest(signedRequest(t, other, ""), secret, time.Minute); err == nil {
+		t.Errorf("Request signed with another secret accepted")
+	}
+}
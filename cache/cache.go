@@ -4,25 +4,76 @@ import (
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/tywkeene/autobd/index"
+	"github.com/tywkeene/autobd/utils"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
-var rootCache map[string]*index.Index
+//The cached index of the root directory, one for each hash algorithm the server uses,
+//indexed by algorithm
+var rootCaches = make(map[string]map[string]*index.Index)
 
-func Initialize(rootPath string) error {
+//For synchronized access to rootCaches. Updates never modify the maps or indexes
+//already in the cache, they build new ones and swap them in, so a map returned by
+//Get() stays consistent after the lock is released
+var lock = sync.RWMutex{}
+
+//Serializes updates, so two updates can't both build on the same old cache
+var updateLock = sync.Mutex{}
+
+//Initialize generates the cached index of rootPath, hashing files with each of algorithms
+func Initialize(rootPath string, algorithms []string) error {
 	var validPath string
 	var err error
 	validPath, err = index.ValidateDirectory(rootPath)
 	if err != nil {
 		return err
 	}
-	log.Infof("Generating root cache index for (%s). This may take a minute...", rootPath)
-	rootCache, err = index.GetIndex(validPath)
-	if err != nil {
-		return err
+	for _, algorithm := range algorithms {
+		if index.SupportedAlgorithm(algorithm) == false {
+			return fmt.Errorf("Unsupported hash algorithm '%s'", algorithm)
+		}
+		log.Infof("Generating root cache index for (%s) with %s. This may take a minute...", rootPath, algorithm)
+		newCache, err := index.GetIndexWith(validPath, algorithm)
+		if err != nil {
+			return err
+		}
+		lock.Lock()
+		rootCaches[algorithm] = newCache
+		lock.Unlock()
+		err = index.SaveState(newCache)
+		utils.HandleError(err, utils.ErrorActionWarn)
 	}
 	return nil
 }
 
+//Algorithms returns the hash algorithms the cache has an index for
+func Algorithms() []string {
+	lock.RLock()
+	defer lock.RUnlock()
+	algorithms := make([]string, 0, len(rootCaches))
+	for algorithm := range rootCaches {
+		algorithms = append(algorithms, algorithm)
+	}
+	sort.Strings(algorithms)
+	return algorithms
+}
+
+//getRoot returns the cached index of the root directory for algorithm. Must be called with lock held
+func getRoot(algorithm string) (map[string]*index.Index, error) {
+	if algorithm == "" {
+		algorithm = index.DefaultAlgorithm
+	}
+	root, ok := rootCaches[algorithm]
+	if ok == false {
+		return nil, fmt.Errorf("No index with hash algorithm '%s'", algorithm)
+	}
+	return root, nil
+}
+
 func FindDirectory(dirPath string, within map[string]*index.Index) map[string]*index.Index {
 	for _, item := range within {
 		if item.IsDir == true {
@@ -37,11 +88,18 @@ func FindDirectory(dirPath string, within map[string]*index.Index) map[string]*i
 	return nil
 }
 
-func Get(dirPath string) (map[string]*index.Index, error) {
+//Get returns the cached index of dirPath, hashed with algorithm
+func Get(dirPath string, algorithm string) (map[string]*index.Index, error) {
 	validPath, err := index.ValidateDirectory(dirPath)
 	if err != nil {
 		return nil, err
 	}
+	lock.RLock()
+	defer lock.RUnlock()
+	rootCache, err := getRoot(algorithm)
+	if err != nil {
+		return nil, err
+	}
 	if validPath == "./" {
 		return rootCache, nil
 	}
@@ -50,3 +108,168 @@ func Get(dirPath string) (map[string]*index.Index, error) {
 	}
 	return nil, fmt.Errorf("Could not find directory '%s'", validPath)
 }
+
+//GetFile returns the cached index of the file at filePath, hashed with algorithm, or nil if
+//it isn't in the cache
+func GetFile(filePath string, algorithm string) *index.Index {
+	filePath = path.Clean(filePath)
+	dirPath := path.Dir(filePath)
+	lock.RLock()
+	defer lock.RUnlock()
+	rootCache, err := getRoot(algorithm)
+	if err != nil {
+		return nil
+	}
+	files := rootCache
+	if dirPath != "." {
+		files = FindDirectory(dirPath, rootCache)
+	}
+	return files[filePath]
+}
+
+//isWithin reports whether name is dirPath or one of its parent directories
+func isWithin(name string, dirPath string) bool {
+	return name == dirPath || strings.HasPrefix(dirPath, name+"/")
+}
+
+//replaceDirectory returns a copy of within, with the contents of the directory at dirPath
+//replaced by files. Only the directories on the way to dirPath are copied, and have their
+//checksums recomputed, everything else is shared with within. Returns false if dirPath isn't in within
+func replaceDirectory(dirPath string, files map[string]*index.Index,
+	within map[string]*index.Index) (map[string]*index.Index, bool) {
+	for name, item := range within {
+		if item.IsDir == false || isWithin(name, dirPath) == false {
+			continue
+		}
+		replaced := *item
+		if name == dirPath {
+			replaced.Files = files
+		} else {
+			children, found := replaceDirectory(dirPath, files, item.Files)
+			if found == false {
+				return nil, false
+			}
+			replaced.Files = children
+		}
+		replaced.Checksum = index.DirChecksum(replaced.Files, replaced.Algorithm)
+		copied := make(map[string]*index.Index, len(within))
+		for key, value := range within {
+			copied[key] = value
+		}
+		copied[name] = &replaced
+		return copied, true
+	}
+	return nil, false
+}
+
+//Update regenerates the cached index of dirPath from disk, only rehashing files whose size
+//or modification time changed. If recursive is false, only the direct children of dirPath are
+//checked. If dirPath is gone, or isn't in the cache yet, its parent directory is updated instead
+func Update(dirPath string, recursive bool) error {
+	defer utils.TimeTrack(time.Now(), "cache/Update()")
+	updateLock.Lock()
+	defer updateLock.Unlock()
+	algorithms := Algorithms()
+	if len(algorithms) == 0 {
+		return nil
+	}
+	//Every index has the same files, so the changes to the journal only need to come from one of them
+	before, _ := Get("./", algorithms[0])
+	for _, algorithm := range algorithms {
+		if err := update(path.Clean(dirPath), recursive, algorithm); err != nil {
+			return err
+		}
+	}
+	after, _ := Get("./", algorithms[0])
+	record(diff(before, after, make([]index.Change, 0)))
+	return nil
+}
+
+func update(dirPath string, recursive bool, algorithm string) error {
+	if dirPath == "." || dirPath == "/" {
+		dirPath = "./"
+	}
+	lock.RLock()
+	current := rootCaches[algorithm]
+	lock.RUnlock()
+
+	var previous map[string]*index.Index
+	if dirPath == "./" {
+		previous = current
+	} else if previous = FindDirectory(dirPath, current); previous == nil {
+		return update(path.Dir(dirPath), false, algorithm)
+	}
+
+	if _, err := index.ValidateDirectory(dirPath); err != nil {
+		if dirPath == "./" {
+			return err
+		}
+		return update(path.Dir(dirPath), false, algorithm)
+	}
+	files, err := index.UpdateIndex(dirPath, previous, recursive, algorithm)
+	if err != nil {
+		return err
+	}
+
+	if dirPath == "./" {
+		lock.Lock()
+		rootCaches[algorithm] = files
+		lock.Unlock()
+		return nil
+	}
+	newCache, found := replaceDirectory(dirPath, files, current)
+	if found == false {
+		return update(path.Dir(dirPath), false, algorithm)
+	}
+	lock.Lock()
+	rootCaches[algorithm] = newCache
+	lock.Unlock()
+	return nil
+}
+
+//updateAll updates every directory in dirs, parents before their children, so that
+//new directories are in the cache before anything below them is updated. Directories
+//mapped to true are updated recursively
+func updateAll(dirs map[string]bool) {
+	sorted := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		sorted = append(sorted, dir)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return strings.Count(sorted[i], "/") < strings.Count(sorted[j], "/")
+	})
+	for _, dir := range sorted {
+		err := Update(dir, dirs[dir])
+		utils.HandleError(err, utils.ErrorActionWarn)
+	}
+}
+
+//Watch keeps the cache of rootPath up to date. Changes are picked up through filesystem
+//notifications where the platform supports them, and the whole tree is rescanned every
+//rescanInterval in case any notifications were missed. A rescanInterval of 0 disables rescanning
+func Watch(rootPath string, notify bool, rescanInterval time.Duration) {
+	if notify == true {
+		if err := watch(rootPath); err != nil {
+			log.Warnf("Filesystem notifications unavailable (%s), falling back to rescanning", err.Error())
+		} else {
+			log.Infof("Watching (%s) for changes", rootPath)
+		}
+	}
+	if rescanInterval <= 0 {
+		return
+	}
+	log.Infof("Rescanning (%s) every %s", rootPath, rescanInterval)
+	go func() {
+		for {
+			time.Sleep(rescanInterval)
+			err := Update(rootPath, true)
+			utils.HandleError(err, utils.ErrorActionErr)
+			//Every index has the same files, so any of them will do
+			if algorithms := Algorithms(); len(algorithms) > 0 {
+				current, _ := Get("./", algorithms[0])
+				err = index.SaveState(current)
+				utils.HandleError(err, utils.ErrorActionWarn)
+			}
+		}
+	}()
+}
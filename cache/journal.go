@@ -0,0 +1,136 @@
+package cache
+
+import (
+	"github.com/tywkeene/autobd/index"
+	"github.com/tywkeene/autobd/options"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//The most recent changes to the cache, oldest first
+var journal = make([]index.Change, 0)
+
+//Set when the server starts, so nodes can tell when sequence numbers start over
+var journalID = strconv.FormatInt(time.Now().UnixNano(), 36)
+
+//Sequence number of the last change recorded
+var sequence uint64
+
+//Closed and replaced with a new channel whenever changes are recorded, to wake up everyone waiting for them
+var journalUpdated = make(chan struct{})
+
+//For synchronized access to the journal
+var journalLock = sync.RWMutex{}
+
+//Updated returns a channel that's closed the next time changes are recorded
+func Updated() <-chan struct{} {
+	journalLock.RLock()
+	defer journalLock.RUnlock()
+	return journalUpdated
+}
+
+//JournalID returns the identifier of the journal, which changes whenever the server restarts
+func JournalID() string {
+	return journalID
+}
+
+//Changes returns the changes recorded after since, and the sequence number of the latest one.
+//Returns false if changes after since were dropped from the journal, in which case the caller
+//can't know what changed and has to look at the whole tree
+func Changes(since uint64) ([]index.Change, uint64, bool) {
+	journalLock.RLock()
+	defer journalLock.RUnlock()
+	if since > sequence {
+		return nil, sequence, false
+	}
+	//The journal holds every change after oldest
+	oldest := sequence - uint64(len(journal))
+	if since < oldest {
+		return nil, sequence, false
+	}
+	changes := make([]index.Change, len(journal)-int(since-oldest))
+	copy(changes, journal[since-oldest:])
+	return changes, sequence, true
+}
+
+//ChangesBelow returns the changes to dir itself, and to everything below it
+func ChangesBelow(changes []index.Change, dir string) []index.Change {
+	dir = path.Clean(dir)
+	below := make([]index.Change, 0)
+	for _, change := range changes {
+		if dir == "." || change.Name == dir || strings.HasPrefix(change.Name, dir+"/") == true {
+			below = append(below, change)
+		}
+	}
+	return below
+}
+
+//record numbers changes and adds them to the journal, dropping the oldest ones once it
+//holds more than options.Config.JournalSize
+func record(changes []index.Change) {
+	if len(changes) == 0 {
+		return
+	}
+	journalLock.Lock()
+	defer journalLock.Unlock()
+	for _, change := range changes {
+		sequence++
+		change.Sequence = sequence
+		journal = append(journal, change)
+	}
+	if size := options.Config.JournalSize; size >= 0 && len(journal) > size {
+		journal = append(make([]index.Change, 0, size), journal[len(journal)-size:]...)
+	}
+	close(journalUpdated)
+	journalUpdated = make(chan struct{})
+}
+
+//sortedNames returns the names in files, sorted so changes are recorded in a stable order
+func sortedNames(files map[string]*index.Index) []string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//modified reports whether a file or directory that exists in both indexes changed
+func modified(before *index.Index, after *index.Index) bool {
+	return before.Mode != after.Mode || before.UID != after.UID || before.GID != after.GID ||
+		before.Link != after.Link || (before.IsDir == false && (before.Checksum != after.Checksum ||
+		before.Size != after.Size || before.ModTime != after.ModTime || before.LinkGroup != after.LinkGroup))
+}
+
+//diff appends the changes that turn before into after to changes. Directories with the same
+//checksum on both sides have identical contents, so they're skipped without looking inside
+func diff(before map[string]*index.Index, after map[string]*index.Index, changes []index.Change) []index.Change {
+	for _, name := range sortedNames(after) {
+		newObject := after[name]
+		oldObject, existed := before[name]
+		if existed == true && oldObject.IsDir != newObject.IsDir {
+			changes = append(changes, index.Change{Event: index.EventDelete, Name: name, IsDir: oldObject.IsDir})
+			existed = false
+		}
+		if existed == false {
+			changes = append(changes, index.Change{Event: index.EventCreate, Name: name, IsDir: newObject.IsDir})
+			continue
+		}
+		if modified(oldObject, newObject) == true {
+			changes = append(changes, index.Change{Event: index.EventModify, Name: name, IsDir: newObject.IsDir})
+		}
+		if newObject.IsDir == true && (newObject.Checksum == "" || oldObject.Checksum != newObject.Checksum) {
+			changes = diff(oldObject.Files, newObject.Files, changes)
+		}
+	}
+	for _, name := range sortedNames(before) {
+		if _, exists := after[name]; exists == false {
+			changes = append(changes, index.Change{Event: index.EventDelete, Name: name, IsDir: before[name].IsDir})
+		}
+	}
+	return changes
+}
@@ -0,0 +1,78 @@
+package cache_test
+
+import (
+	"github.com/tywkeene/autobd/cache"
+	"github.com/tywkeene/autobd/index"
+	"github.com/tywkeene/autobd/options"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+	os.MkdirAll("a/b", 0755)
+	ioutil.WriteFile("a/b/file", []byte("before"), 0644)
+	ioutil.WriteFile("gone", []byte("gone"), 0644)
+	options.Config.JournalSize = 3
+
+	if err := cache.Initialize("./", []string{index.DefaultAlgorithm}); err != nil {
+		t.Fatal(err)
+	}
+	_, start, complete := cache.Changes(0)
+	if complete == false {
+		t.Fatal("A new journal should be complete")
+	}
+
+	ioutil.WriteFile("a/b/file", []byte("after"), 0644)
+	os.Remove("gone")
+	os.Mkdir("new", 0755)
+	if err := cache.Update("./", true); err != nil {
+		t.Fatal(err)
+	}
+	changes, latest, complete := cache.Changes(start)
+	expected := []index.Change{
+		{Sequence: start + 1, Event: index.EventModify, Name: "a/b/file"},
+		{Sequence: start + 2, Event: index.EventCreate, Name: "new", IsDir: true},
+		{Sequence: start + 3, Event: index.EventDelete, Name: "gone"},
+	}
+	if complete == false || latest != start+3 || len(changes) != len(expected) {
+		t.Fatalf("Got %v up to %d, expected %v", changes, latest, expected)
+	}
+	for i := range expected {
+		if changes[i] != expected[i] {
+			t.Errorf("Got %v, expected %v", changes[i], expected[i])
+		}
+	}
+	if changes, _, _ := cache.Changes(latest); len(changes) != 0 {
+		t.Errorf("Expected no changes since the latest, got %v", changes)
+	}
+
+	os.Mkdir("newer", 0755)
+	cache.Update("./", false)
+	if _, _, complete := cache.Changes(start); complete == true {
+		t.Error("Changes that were dropped from the journal should make it incomplete")
+	}
+}
+
+//Ensure changes to a directory itself are sent to nodes syncing that directory
+func TestChangesBelow(t *testing.T) {
+	changes := []index.Change{
+		{Sequence: 1, Event: index.EventModify, Name: "a", IsDir: true},
+		{Sequence: 2, Event: index.EventCreate, Name: "a/b/file"},
+		{Sequence: 3, Event: index.EventCreate, Name: "ab"},
+	}
+	if below := cache.ChangesBelow(changes, "./a/"); len(below) != 2 || below[0].Name != "a" || below[1].Name != "a/b/file" {
+		t.Errorf("Expected the changes to a and a/b/file, got %v", below)
+	}
+	if below := cache.ChangesBelow(changes, "./"); len(below) != len(changes) {
+		t.Errorf("Expected every change below the root, got %v", below)
+	}
+}
@@ -0,0 +1,171 @@
+// +build linux
+
+package cache
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/tywkeene/autobd/options"
+	"github.com/tywkeene/autobd/utils"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const watchMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+
+//How long to wait for more events before applying changes to the cache, so a burst of
+//writes to the same directory only updates it once
+const settleTime = time.Second
+
+//change is a directory whose cached index needs updating
+type change struct {
+	dirPath   string
+	recursive bool //Set when everything below the directory needs updating too
+}
+
+type watcher struct {
+	fd      int
+	watches map[int]string //Watched directories indexed by watch descriptor
+	lock    sync.Mutex
+	changed chan change
+}
+
+//watch sets up inotify watches on every directory under rootPath
+func watch(rootPath string) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	w := &watcher{fd: fd, watches: make(map[int]string), changed: make(chan change, 1024)}
+	if err := w.addTree(rootPath); err != nil {
+		syscall.Close(fd)
+		return err
+	}
+	go w.readEvents()
+	go w.applyChanges(rootPath)
+	return nil
+}
+
+//addTree adds a watch to dirPath and every directory below it
+func (w *watcher) addTree(dirPath string) error {
+	return filepath.Walk(dirPath, func(walkPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			//The directory may have been removed before we got to it
+			if os.IsNotExist(err) == true {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() == false {
+			return nil
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, walkPath, watchMask)
+		if err != nil {
+			return err
+		}
+		w.lock.Lock()
+		w.watches[wd] = cleanPath(walkPath)
+		w.lock.Unlock()
+		return nil
+	})
+}
+
+//cleanPath returns dirPath in the same form the index uses for its keys
+func cleanPath(dirPath string) string {
+	dirPath = path.Clean(dirPath)
+	if dirPath == "." {
+		return "./"
+	}
+	return strings.TrimPrefix(dirPath, "./")
+}
+
+func (w *watcher) readEvents() {
+	var buffer [syscall.SizeofInotifyEvent * 4096]byte
+	for {
+		n, err := syscall.Read(w.fd, buffer[:])
+		if err == syscall.EINTR {
+			continue
+		}
+		if n <= 0 || err != nil {
+			if err == nil {
+				err = syscall.EIO
+			}
+			log.Errorf("Stopped watching for changes: %s", err.Error())
+			return
+		}
+		var offset int
+		for offset <= n-syscall.SizeofInotifyEvent {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buffer[offset]))
+			nameBytes := buffer[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+			name := strings.TrimRight(string(nameBytes), "\x00")
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+			w.handleEvent(int(event.Wd), event.Mask, name)
+		}
+	}
+}
+
+func (w *watcher) handleEvent(wd int, mask uint32, name string) {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		log.Warn("Filesystem notification queue overflowed, rescanning")
+		w.changed <- change{"./", true}
+		return
+	}
+	w.lock.Lock()
+	dirPath, ok := w.watches[wd]
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(w.watches, wd)
+	}
+	w.lock.Unlock()
+	if ok == false {
+		return
+	}
+	if mask&(syscall.IN_DELETE_SELF|syscall.IN_MOVE_SELF) != 0 {
+		w.changed <- change{path.Dir(dirPath), false}
+		return
+	}
+	if mask&syscall.IN_ISDIR != 0 && mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+		err := w.addTree(path.Join(dirPath, name))
+		utils.HandleError(err, utils.ErrorActionWarn)
+	}
+	//The ignore rules in a directory apply to everything below it
+	if name == options.Config.IgnoreFile {
+		err := w.addTree(dirPath)
+		utils.HandleError(err, utils.ErrorActionWarn)
+		w.changed <- change{dirPath, true}
+		return
+	}
+	w.changed <- change{dirPath, false}
+}
+
+//applyChanges collects changed directories until no events arrive for settleTime,
+//then updates them in the cache
+func (w *watcher) applyChanges(rootPath string) {
+	dirty := make(map[string]bool)
+	timer := time.NewTimer(settleTime)
+	timer.Stop()
+	for {
+		select {
+		case changed := <-w.changed:
+			dirPath := changed.dirPath
+			if dirPath == "." {
+				dirPath = "./"
+			}
+			dirty[dirPath] = dirty[dirPath] || changed.recursive
+			timer.Reset(settleTime)
+		case <-timer.C:
+			if _, ok := dirty["./"]; ok == true {
+				err := Update(rootPath, true)
+				utils.HandleError(err, utils.ErrorActionErr)
+			} else {
+				updateAll(dirty)
+			}
+			dirty = make(map[string]bool)
+		}
+	}
+}
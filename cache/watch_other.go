@@ -0,0 +1,12 @@
+// +build !linux
+
+package cache
+
+import (
+	"fmt"
+)
+
+//Filesystem notifications are only implemented on linux, other platforms rely on rescanning
+func watch(rootPath string) error {
+	return fmt.Errorf("not supported on this platform")
+}
@@ -0,0 +1,158 @@
+//Package certs loads the certificates used for TLS between nodes and servers, and checks
+//the certificates presented on either side
+package certs
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+//LoadPool reads the PEM encoded CA certificates in filename
+func LoadPool(filename string) (*x509.CertPool, error) {
+	serial, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if pool.AppendCertsFromPEM(serial) == false {
+		return nil, fmt.Errorf("No PEM encoded certificates in %s", filename)
+	}
+	return pool, nil
+}
+
+//Fingerprint returns the SHA256 of the DER encoded certificate, hex encoded
+func Fingerprint(certificate *x509.Certificate) string {
+	sum := sha256.Sum256(certificate.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+//NormalizeFingerprint lowercases fingerprint and strips the colons it's often written with,
+//so "AB:CD:..." matches what Fingerprint() returns
+func NormalizeFingerprint(fingerprint string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(fingerprint), ":", "", -1))
+}
+
+//Pin is the fingerprint a server's certificate, or one of the certificates that signed it, has to match.
+//A pin without a fingerprint trusts the first chain it sees, pinning the last certificate in it, and only
+//accepts chains holding that one from then on. When a server sends its CA along, nodes pin the CA, and keep
+//trusting the server when it replaces its certificate with another one the CA signed
+type Pin struct {
+	fingerprint string
+	pinned      func(fingerprint string) //Called when the first certificate is trusted
+	lock        sync.Mutex
+}
+
+//NewPin returns a pin for fingerprint, or one that trusts the first certificate it sees if fingerprint
+//is empty, and calls pinned with its fingerprint so it can be saved
+func NewPin(fingerprint string, pinned func(fingerprint string)) *Pin {
+	return &Pin{fingerprint: NormalizeFingerprint(fingerprint), pinned: pinned}
+}
+
+//Fingerprint returns the fingerprint the server's certificate has to match, empty if none was seen yet
+func (p *Pin) Fingerprint() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.fingerprint
+}
+
+//parseChain parses the certificates a server presented, starting with its own, and stops at the first one
+//that didn't sign the one before it
+func parseChain(rawCerts [][]byte) ([]*x509.Certificate, error) {
+	if len(rawCerts) == 0 {
+		return nil, fmt.Errorf("No certificate presented")
+	}
+	chain := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		certificate, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return nil, err
+		}
+		if len(chain) > 0 && chain[len(chain)-1].CheckSignatureFrom(certificate) != nil {
+			break
+		}
+		chain = append(chain, certificate)
+	}
+	return chain, nil
+}
+
+//verify is a tls.Config.VerifyPeerCertificate that only accepts a server whose certificate, or one of the
+//certificates that signed it, matches the pin
+func (p *Pin) verify(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	chain, err := parseChain(rawCerts)
+	if err != nil {
+		return err
+	}
+	p.lock.Lock()
+	if p.fingerprint == "" {
+		actual := Fingerprint(chain[len(chain)-1])
+		p.fingerprint = actual
+		p.lock.Unlock()
+		if p.pinned != nil {
+			p.pinned(actual)
+		}
+		return nil
+	}
+	defer p.lock.Unlock()
+	for _, certificate := range chain {
+		if Fingerprint(certificate) == p.fingerprint {
+			return nil
+		}
+	}
+	return fmt.Errorf("Certificate fingerprint %s doesn't match the pinned %s", Fingerprint(chain[0]), p.fingerprint)
+}
+
+//ClientConfig returns the TLS configuration a node connects to a server with. The server is verified
+//against the CA certificates in caFile, and if pin isn't nil, its certificate has to match it.
+//Without either the server isn't verified at all. If certFile and keyFile are set, the node presents
+//that certificate to servers that require one
+func ClientConfig(caFile string, certFile string, keyFile string, pin *Pin) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: true}
+	if caFile != "" {
+		pool, err := LoadPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+		config.InsecureSkipVerify = false
+	}
+	if pin != nil {
+		config.VerifyPeerCertificate = pin.verify
+	}
+	if certFile != "" || keyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	return config, nil
+}
+
+//ServerConfig returns the TLS configuration a server requires node certificates signed by the
+//CA certificates in clientCAFile with. Returns nil if clientCAFile is empty
+func ServerConfig(clientCAFile string) (*tls.Config, error) {
+	if clientCAFile == "" {
+		return nil, nil
+	}
+	pool, err := LoadPool(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}, nil
+}
+
+//Identity returns the common name of the verified certificate the client presented with request,
+//or an empty string if it didn't present one
+func Identity(request *http.Request) string {
+	if request.TLS == nil || len(request.TLS.VerifiedChains) == 0 || len(request.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	return request.TLS.PeerCertificates[0].Subject.CommonName
+}
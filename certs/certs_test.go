@@ -0,0 +1,100 @@
+package certs_test
+
+import (
+	"crypto/tls"
+	"github.com/tywkeene/autobd/certs"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+//newServer starts a TLS server with the certificate in certFile and keyFile
+func newServer(t *testing.T, certFile string, keyFile string) *httptest.Server {
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{certificate}}
+	server.StartTLS()
+	return server
+}
+
+func get(t *testing.T, url string, pin *certs.Pin, caFile string) error {
+	config, err := certs.ClientConfig(caFile, "", "", pin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	response, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+//Ensure a generated certificate is kept, and the server's CA is trusted on first use, so a certificate
+//generated again is still trusted, and a server with another CA is refused
+func TestGenerate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile, generated, err := certs.Generate(path.Join(dir, "tls"), []string{"127.0.0.1", "localhost"})
+	if err != nil || generated == false {
+		t.Fatalf("Certificate not generated: %v", err)
+	}
+	fingerprint, err := certs.FileFingerprint(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, generated, _ := certs.Generate(path.Join(dir, "tls"), []string{"127.0.0.1"}); generated == true {
+		t.Errorf("Certificate generated again")
+	}
+
+	server := newServer(t, certFile, keyFile)
+	defer server.Close()
+
+	//Verified by the generated CA, with the certificate issued for 127.0.0.1
+	if err := get(t, server.URL, nil, path.Join(dir, "tls", certs.CAFile)); err != nil {
+		t.Errorf("Server not verified by the generated CA: %s", err.Error())
+	}
+
+	var trusted string
+	pin := certs.NewPin("", func(fingerprint string) { trusted = fingerprint })
+	if err := get(t, server.URL, pin, ""); err != nil {
+		t.Fatal(err)
+	}
+	if trusted != fingerprint || pin.Fingerprint() != fingerprint {
+		t.Errorf("Pinned %s, expected %s", trusted, fingerprint)
+	}
+	upper := strings.ToUpper(fingerprint[:2]) + ":" + fingerprint[2:]
+	if err := get(t, server.URL, certs.NewPin(upper, nil), ""); err != nil {
+		t.Errorf("Configured fingerprint refused: %s", err.Error())
+	}
+
+	//The server's certificate is generated again, and signed by the same CA
+	os.Remove(certFile)
+	if _, _, generated, err := certs.Generate(path.Join(dir, "tls"), []string{"127.0.0.1"}); err != nil || generated == false {
+		t.Fatalf("Certificate not generated again: %v", err)
+	}
+	regenerated := newServer(t, certFile, keyFile)
+	defer regenerated.Close()
+	if err := get(t, regenerated.URL, pin, ""); err != nil {
+		t.Errorf("Server with a new certificate from the pinned CA refused: %s", err.Error())
+	}
+
+	//A server with another certificate is refused by the same pin
+	other := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer other.Close()
+	if err := get(t, other.URL, pin, ""); err == nil {
+		t.Errorf("Server with another certificate accepted")
+	}
+}
@@ -0,0 +1,227 @@
+package certs
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"github.com/tywkeene/autobd/utils"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"time"
+)
+
+//Names of the files Generate() keeps in its directory
+const (
+	CAFile   = "ca.pem"
+	CAKey    = "ca-key.pem"
+	CertFile = "cert.pem"
+	KeyFile  = "key.pem"
+)
+
+//How long generated certificates are valid for
+const validFor = 10 * 365 * 24 * time.Hour
+
+func serialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+//writePEM writes a PEM block of blockType for each of ders to filename
+func writePEM(filename string, blockType string, ders ...[]byte) error {
+	var serial bytes.Buffer
+	for _, der := range ders {
+		if err := pem.Encode(&serial, &pem.Block{Type: blockType, Bytes: der}); err != nil {
+			return err
+		}
+	}
+	return utils.WriteFile(filename, &serial, nil)
+}
+
+func writeKey(filename string, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return writePEM(filename, "EC PRIVATE KEY", der)
+}
+
+//readPEM returns the DER bytes of the first PEM block in filename
+func readPEM(filename string) ([]byte, error) {
+	serial, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(serial)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data in %s", filename)
+	}
+	return block.Bytes, nil
+}
+
+//readCertificates returns every certificate in the PEM encoded filename, in order
+func readCertificates(filename string) ([]*x509.Certificate, error) {
+	serial, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var certificates []*x509.Certificate
+	for block, rest := pem.Decode(serial); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certificates = append(certificates, certificate)
+	}
+	if len(certificates) == 0 {
+		return nil, fmt.Errorf("No certificates in %s", filename)
+	}
+	return certificates, nil
+}
+
+//FileFingerprint returns the fingerprint nodes pin for the certificate chain in the PEM encoded filename:
+//the fingerprint of its last certificate, which is the CA when the file holds the chain Generate() writes
+func FileFingerprint(filename string) (string, error) {
+	certificates, err := readCertificates(filename)
+	if err != nil {
+		return "", err
+	}
+	return Fingerprint(certificates[len(certificates)-1]), nil
+}
+
+//create signs template with the parent certificate's key, and writes it followed by chain to certFile,
+//and key to keyFile
+func create(template *x509.Certificate, parent *x509.Certificate, signer crypto.Signer, key *ecdsa.PrivateKey,
+	certFile string, keyFile string, chain ...[]byte) (*x509.Certificate, error) {
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), signer)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeKey(keyFile, key); err != nil {
+		return nil, err
+	}
+	if err := writePEM(certFile, "CERTIFICATE", append([][]byte{der}, chain...)...); err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+//loadCA reads the certificate authority in dir, or generates a new one if there isn't one yet
+func loadCA(dir string, name string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certDER, certErr := readPEM(path.Join(dir, CAFile))
+	keyDER, keyErr := readPEM(path.Join(dir, CAKey))
+	if certErr == nil && keyErr == nil {
+		certificate, err := x509.ParseCertificate(certDER)
+		if err != nil {
+			return nil, nil, err
+		}
+		key, err := x509.ParseECPrivateKey(keyDER)
+		if err != nil {
+			return nil, nil, err
+		}
+		return certificate, key, nil
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "Autobd CA " + name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(validFor),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	certificate, err := create(template, template, key, key, path.Join(dir, CAFile), path.Join(dir, CAKey))
+	if err != nil {
+		return nil, nil, err
+	}
+	return certificate, key, nil
+}
+
+//addCA appends the certificate authority in dir to certFile, if certFile only holds a certificate it signed.
+//Certificates generated before the CA was sent along with them are upgraded this way
+func addCA(dir string, certFile string) error {
+	certificates, err := readCertificates(certFile)
+	if err != nil {
+		return err
+	}
+	ca, err := readCertificates(path.Join(dir, CAFile))
+	if os.IsNotExist(err) == true {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if len(certificates) != 1 || certificates[0].CheckSignatureFrom(ca[0]) != nil {
+		return nil
+	}
+	return writePEM(certFile, "CERTIFICATE", certificates[0].Raw, ca[0].Raw)
+}
+
+//Generate makes sure dir holds a certificate authority, and a certificate for hosts signed by it, generating
+//whatever is missing. hosts are host names or IP addresses, the first one is the certificate's common name.
+//The certificate file holds the CA too, so servers present it and nodes can pin it, which keeps them
+//trusting the server when its certificate is generated again.
+//Returns the paths of the certificate and its key, and whether they were just generated
+func Generate(dir string, hosts []string) (string, string, bool, error) {
+	certFile := path.Join(dir, CertFile)
+	keyFile := path.Join(dir, KeyFile)
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if certErr == nil && keyErr == nil {
+		return certFile, keyFile, false, addCA(dir, certFile)
+	}
+	if len(hosts) == 0 {
+		return "", "", false, fmt.Errorf("No host names to generate a certificate for")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", "", false, err
+	}
+	ca, caKey, err := loadCA(dir, hosts[0])
+	if err != nil {
+		return "", "", false, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", false, err
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return "", "", false, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(validFor),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	if _, err := create(template, ca, caKey, key, certFile, keyFile, ca.Raw); err != nil {
+		return "", "", false, err
+	}
+	return certFile, keyFile, true, nil
+}
@@ -9,16 +9,22 @@ import (
 	"encoding/json"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
+	"github.com/tywkeene/autobd/auth"
+	"github.com/tywkeene/autobd/delta"
+	"github.com/tywkeene/autobd/index"
 	"github.com/tywkeene/autobd/nodelist"
 	"github.com/tywkeene/autobd/packing"
+	"github.com/tywkeene/autobd/throttle"
 	"github.com/tywkeene/autobd/utils"
 	"github.com/tywkeene/autobd/version"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"strconv"
+	"sync/atomic"
 )
 
 //The Connection struct describes a connection to a server, it's status, and an http client
@@ -28,7 +34,32 @@ type Connection struct {
 	Online      bool         //Is this server online
 	Synced      bool         //Is the node synced with this server?
 	UserAgent   string       //The useragent the node will send to this server
+	Algorithm   string       //Hash algorithm this server indexes with for the node
+	Journal     string       //The server's change journal, as of the last time the node was synced
+	Sequence    uint64       //Sequence number of the last change in Journal the node is synced with
+	Skipped     int          //Syncs skipped in a row because nothing changed on the server
+	NodeUUID    string       //UUID of the node, requests are signed in its name
+	Secret      string       //The secret this server gave the node when it enrolled, empty until then
 	client      *http.Client //connection configuration for this server
+	noBlobs     int32        //Set to 1 if the server can't serve files by checksum, accessed atomically
+}
+
+//Limits the bandwidth used by downloads from all servers together, nil for no limit
+var downloadLimiter *throttle.Limiter
+
+//LimitDownloads limits the rate responses from every server are read at to limiter. A nil limiter removes the limit
+func LimitDownloads(limiter *throttle.Limiter) {
+	downloadLimiter = limiter
+}
+
+//limitedBody reads a response body no faster than downloadLimiter allows
+type limitedBody struct {
+	io.Reader
+	body io.Closer
+}
+
+func (l *limitedBody) Close() error {
+	return l.body.Close()
 }
 
 func (connection *Connection) HandleAPIError(response *http.Response, expectStatus int) error {
@@ -48,9 +79,14 @@ func (connection *Connection) HandleAPIError(response *http.Response, expectStat
 	return nil
 }
 
-func NewConnection(address string, userAgent string) *Connection {
+//NewConnection returns a connection to the server at address. TLS connections are made with tlsConfig,
+//which doesn't verify the server if it's nil
+func NewConnection(address string, userAgent string, tlsConfig *tls.Config) *Connection {
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{InsecureSkipVerify: true}
+	}
 	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		TLSClientConfig: tlsConfig,
 	}
 	connection := &http.Client{Transport: tr}
 	return &Connection{
@@ -59,6 +95,7 @@ func NewConnection(address string, userAgent string) *Connection {
 		Online:      true,
 		Synced:      false,
 		UserAgent:   userAgent,
+		Algorithm:   index.DefaultAlgorithm,
 		client:      connection,
 	}
 }
@@ -105,17 +142,21 @@ func (connection *Connection) SetRequestHeaders(request *http.Request) {
 	request.Header.Set("User-Agent", connection.UserAgent)
 }
 
+func SetQueryValues(request *http.Request, values map[string]string) {
+	query := request.URL.Query()
+	for name, value := range values {
+		query.Add(name, value)
+	}
+	request.URL.RawQuery = query.Encode()
+}
+
 func (connection *Connection) ConstructGetRequest(endpoint string, values map[string]string) *http.Request {
 	request, err := http.NewRequest("GET", connection.ConstructUrl(endpoint), nil)
 	if utils.HandleError(err, utils.ErrorActionErr) == true {
 		return nil
 	}
 	connection.SetRequestHeaders(request)
-	query := request.URL.Query()
-	for name, value := range values {
-		query.Add(name, value)
-	}
-	request.URL.RawQuery = query.Encode()
+	SetQueryValues(request, values)
 	return request
 }
 
@@ -133,45 +174,110 @@ func (connection *Connection) ConstructPostRequest(endpoint string, data interfa
 	return request
 }
 
-//Check to see if the reponse is gzip'd, if it is, inflate it, if it's not, just return the
-//normal response body as-is
-func InflateResponse(resp *http.Response) ([]byte, error) {
+//gzipBody closes both the gzip reader and the response body it reads from
+type gzipBody struct {
+	*gzip.Reader
+	body io.Closer
+}
+
+func (g *gzipBody) Close() error {
+	g.Reader.Close()
+	return g.body.Close()
+}
+
+//InflateReader returns a reader for the response body that inflates it if it's gzip'd,
+//or the response body as-is if it's not. Closing the reader closes the response body
+func InflateReader(resp *http.Response) (io.ReadCloser, error) {
 	if resp.Header.Get("Content-Encoding") == "application/x-gzip" {
 		reader, err := gzip.NewReader(resp.Body)
 		if err != nil {
 			return nil, err
 		}
-		defer reader.Close()
-		buffer, err := ioutil.ReadAll(reader)
-		return buffer, err
+		return &gzipBody{reader, resp.Body}, nil
 	}
-	return ioutil.ReadAll(resp.Body)
+	return resp.Body, nil
 }
 
-//HTTP GET with autobd specific headers set, returns a gzip reader if the response is
-//gzipped, a normal response body otherwise
-func (connection *Connection) Get(endpoint string, expectStatus int, queryValues map[string]string) ([]byte, error) {
-	request := connection.ConstructGetRequest(endpoint, queryValues)
+//Check to see if the reponse is gzip'd, if it is, inflate it, if it's not, just return the
+//normal response body as-is
+func InflateResponse(resp *http.Response) ([]byte, error) {
+	reader, err := InflateReader(resp)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+//do signs request with the node's secret, if the server gave it one, sends it to the server, and
+//limits the rate the response body is read at to downloadLimiter
+func (connection *Connection) do(request *http.Request) (*http.Response, error) {
+	if connection.Secret != "" {
+		if err := auth.Sign(request, connection.NodeUUID, connection.Secret); err != nil {
+			return nil, err
+		}
+	}
 	response, err := connection.client.Do(request)
 	if err != nil {
 		return nil, err
 	}
+	if downloadLimiter != nil {
+		response.Body = &limitedBody{Reader: throttle.Reader(response.Body, downloadLimiter), body: response.Body}
+	}
+	return response, nil
+}
+
+//doStream sends request and returns a reader for the (inflated) response body, which the
+//caller must close
+func (connection *Connection) doStream(request *http.Request, expectStatus int) (io.ReadCloser, error) {
+	response, err := connection.do(request)
+	if err != nil {
+		return nil, err
+	}
 	if err := connection.HandleAPIError(response, expectStatus); err != nil {
 		return nil, err
 	}
-	return InflateResponse(response)
+	reader, err := InflateReader(response)
+	if err != nil {
+		response.Body.Close()
+		return nil, err
+	}
+	return reader, nil
 }
 
-func (connection *Connection) Post(endpoint string, expectStatus int, data interface{}) ([]byte, error) {
-	request := connection.ConstructPostRequest(endpoint, data)
-	response, err := connection.client.Do(request)
+//GetStream is like Get, but returns a reader for the response body instead of reading
+//it into memory. The caller must close the reader
+func (connection *Connection) GetStream(endpoint string, expectStatus int, queryValues map[string]string) (io.ReadCloser, error) {
+	return connection.doStream(connection.ConstructGetRequest(endpoint, queryValues), expectStatus)
+}
+
+//HTTP GET with autobd specific headers set, returns a gzip reader if the response is
+//gzipped, a normal response body otherwise
+func (connection *Connection) Get(endpoint string, expectStatus int, queryValues map[string]string) ([]byte, error) {
+	reader, err := connection.GetStream(endpoint, expectStatus, queryValues)
 	if err != nil {
 		return nil, err
 	}
-	if err := connection.HandleAPIError(response, expectStatus); err != nil {
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+//PostStream is like Post, but returns a reader for the response body instead of reading
+//it into memory. The caller must close the reader
+func (connection *Connection) PostStream(endpoint string, expectStatus int, data interface{},
+	queryValues map[string]string) (io.ReadCloser, error) {
+	request := connection.ConstructPostRequest(endpoint, data)
+	SetQueryValues(request, queryValues)
+	return connection.doStream(request, expectStatus)
+}
+
+func (connection *Connection) Post(endpoint string, expectStatus int, data interface{}) ([]byte, error) {
+	reader, err := connection.PostStream(endpoint, expectStatus, data, nil)
+	if err != nil {
 		return nil, err
 	}
-	return InflateResponse(response)
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
 }
 
 func (connection *Connection) RequestVersion() ([]byte, error) {
@@ -182,57 +288,419 @@ func (connection *Connection) RequestVersion() ([]byte, error) {
 	return ioutil.ReadAll(resp.Body)
 }
 
-func (connection *Connection) RequestIndex(dir string, uuid string) ([]byte, error) {
+//RequestIndex requests the server's index of dir. If depth is more than 0, only that many
+//levels of the tree are included
+func (connection *Connection) RequestIndex(dir string, uuid string, depth int) ([]byte, error) {
 	queryValues := make(map[string]string)
 	queryValues["dir"] = dir
 	queryValues["uuid"] = uuid
+	if depth > 0 {
+		queryValues["depth"] = strconv.Itoa(depth)
+	}
 	return connection.Get("/index", http.StatusOK, queryValues)
 }
 
-func (connection *Connection) RequestSyncDir(dir string, uuid string) error {
+//RequestChanges requests the changes below dir since sequence number since of journal. The server
+//sends its whole index of dir instead if it can't tell what changed since then
+func (connection *Connection) RequestChanges(dir string, uuid string, journal string, since uint64) ([]byte, error) {
+	queryValues := make(map[string]string)
+	queryValues["dir"] = dir
+	queryValues["uuid"] = uuid
+	queryValues["journal"] = journal
+	queryValues["since"] = strconv.FormatUint(since, 10)
+	return connection.Get("/changes", http.StatusOK, queryValues)
+}
+
+//WaitForChanges is RequestChanges, but if nothing changed yet, the server holds on to the
+//request until something does, or until it times out
+func (connection *Connection) WaitForChanges(dir string, uuid string, journal string, since uint64) ([]byte, error) {
+	queryValues := make(map[string]string)
+	queryValues["dir"] = dir
+	queryValues["uuid"] = uuid
+	queryValues["journal"] = journal
+	queryValues["since"] = strconv.FormatUint(since, 10)
+	return connection.Get("/wait", http.StatusOK, queryValues)
+}
+
+//regularFiles flattens every regular file under files into a map indexed by file name
+func regularFiles(files map[string]*index.Index, into map[string]*index.Index) map[string]*index.Index {
+	for name, object := range files {
+		if object.IsDir == true {
+			regularFiles(object.Files, into)
+		} else {
+			into[name] = object
+		}
+	}
+	return into
+}
+
+//ChecksumError is returned when a downloaded file doesn't match the checksum in the server's index
+type ChecksumError struct {
+	Name     string
+	Expected string
+	Actual   string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("Checksum mismatch for %s: expected %s got %s", e.Name, e.Expected, e.Actual)
+}
+
+//VerifyChecksum returns a *ChecksumError if the file at tempPath doesn't have the checksum
+//expected for name, computed with algorithm. Files the server didn't give a checksum for aren't checked
+func VerifyChecksum(name string, tempPath string, expected string, algorithm string) error {
+	if expected == "" {
+		return nil
+	}
+	if actual := index.GetChecksumWith(tempPath, algorithm); actual != expected {
+		return &ChecksumError{Name: name, Expected: expected, Actual: actual}
+	}
+	return nil
+}
+
+//RequestSyncDir downloads the directory tree described by object from the server. The tarball is
+//unpacked as it's received, so it's never held in memory, and every file in it is checked against
+//the checksums in object before it replaces the node's copy
+func (connection *Connection) RequestSyncDir(object *index.Index, uuid string) error {
+	dir := object.Name
 	queryValues := make(map[string]string)
 	queryValues["grab"] = dir
 	queryValues["uuid"] = uuid
-	buffer, err := connection.Get("/sync", http.StatusOK, queryValues)
+	reader, err := connection.GetStream("/sync", http.StatusOK, queryValues)
 	if err != nil {
 		return err
 	}
+	defer reader.Close()
 
-	reader := bytes.NewReader(buffer)
-	if err := packing.UnpackDir(reader); err != nil {
+	//make sure we create the directory tree if it's needed
+	if err := os.MkdirAll(dir, 0777); err != nil {
 		return err
 	}
+	expected := regularFiles(object.Files, make(map[string]*index.Index))
+	//Nothing in the tarball may be unpacked outside of the requested directory
+	return packing.UnpackDir(reader, dir, func(name string, tempPath string) error {
+		file, ok := expected[name]
+		if ok == false {
+			return nil
+		}
+		return VerifyChecksum(name, tempPath, file.Checksum, file.Algorithm)
+	})
+}
 
-	//make sure we create the directory tree if it's needed
-	if tree := path.Dir(dir); tree != "" {
-		err := os.MkdirAll(tree, 0777)
+//RequestSyncBatch downloads the regular files in objects from the server with a single request,
+//unpacking them below root. Every file is checked against its checksum in objects before it replaces
+//the node's copy. Returns the names of the files that were written, which may not be all of them
+//if the server left some out, or an error stopped the transfer part way through
+func (connection *Connection) RequestSyncBatch(objects []*index.Index, uuid string, root string) (map[string]bool, error) {
+	expected := make(map[string]*index.Index, len(objects))
+	names := make([]string, 0, len(objects))
+	for _, object := range objects {
+		expected[object.Name] = object
+		names = append(names, object.Name)
+	}
+	queryValues := make(map[string]string)
+	queryValues["uuid"] = uuid
+	written := make(map[string]bool, len(objects))
+	reader, err := connection.PostStream("/batch", http.StatusOK, names, queryValues)
+	if err != nil {
+		return written, err
+	}
+	defer reader.Close()
+	var last string
+	err = packing.UnpackDir(reader, root, func(name string, tempPath string) error {
+		object, ok := expected[name]
+		if ok == false {
+			return fmt.Errorf("Server sent %s, which wasn't requested", name)
+		}
+		if err := VerifyChecksum(name, tempPath, object.Checksum, object.Algorithm); err != nil {
+			return err
+		}
+		written[name] = true
+		last = name
+		return nil
+	})
+	if err != nil {
+		//The last file that was verified may not have made it into place
+		delete(written, last)
+	}
+	return written, err
+}
+
+//StaleError is returned when the server no longer has the version of a file the node asked for,
+//so the node's index of the server is out of date. Retrying won't help until it's compared again
+type StaleError struct {
+	Name string
+	Err  error
+}
+
+func (e *StaleError) Error() string {
+	return fmt.Sprintf("%s changed on the server since it was indexed: %s", e.Name, e.Err.Error())
+}
+
+//partialState is stored next to a partially downloaded file, so the download can be
+//resumed as long as the server's copy hasn't changed since
+type partialState struct {
+	Checksum string `json:"checksum"`
+	Size     int64  `json:"size"`
+}
+
+//PartialPath returns where a file is downloaded to before it's complete
+func PartialPath(file string) string {
+	return path.Join(path.Dir(file), "."+path.Base(file)+".autobd-partial")
+}
+
+//resumeOffset returns how much of object has already been downloaded to partialPath. A partial
+//download of a different version of object is removed, and 0 is returned
+func resumeOffset(partialPath string, object *index.Index) int64 {
+	statePath := partialPath + ".json"
+	serial, err := ioutil.ReadFile(statePath)
+	if err != nil {
+		os.Remove(partialPath)
+		return 0
+	}
+	var state partialState
+	info, err := os.Stat(partialPath)
+	if err != nil || json.Unmarshal(serial, &state) != nil || object.Checksum == "" ||
+		state.Checksum != object.Checksum || state.Size != object.Size || info.Size() > object.Size {
+		os.Remove(partialPath)
+		os.Remove(statePath)
+		return 0
+	}
+	return info.Size()
+}
+
+//discardPartial removes a partial download and its state, so the file is downloaded from the start
+func discardPartial(partialPath string) {
+	os.Remove(partialPath)
+	os.Remove(partialPath + ".json")
+}
+
+//commitPartial checks the complete download of object in partialPath against its checksum, gives it
+//object's metadata, and moves it into place. A download that doesn't match is discarded
+func commitPartial(partialPath string, object *index.Index) error {
+	if err := VerifyChecksum(object.Name, partialPath, object.Checksum, object.Algorithm); err != nil {
+		//Whatever we have is useless, start over next time
+		discardPartial(partialPath)
+		return err
+	}
+	if err := utils.SetMetadata(partialPath, object.Mode, object.ModTime, object.UID, object.GID); err != nil {
+		return err
+	}
+	if err := utils.CommitFile(partialPath, object.Name); err != nil {
+		return err
+	}
+	return os.Remove(partialPath + ".json")
+}
+
+//contentRangeStart returns the first byte of a "Content-Range: bytes start-end/size" header
+func contentRangeStart(header string) (int64, error) {
+	var start, end, size int64
+	if _, err := fmt.Sscanf(header, "bytes %d-%d/%d", &start, &end, &size); err != nil {
+		return 0, fmt.Errorf("Invalid Content-Range '%s': %s", header, err.Error())
+	}
+	return start, nil
+}
+
+//RequestSyncFile downloads object from the server. The file is downloaded to a partial file first,
+//and if the transfer is interrupted, the next call picks up where it left off, as long as the
+//server's copy of the file hasn't changed. Once complete, the partial file is checked against the
+//checksum in object, given object's mode, modification time and ownership, and synced to disk before
+//it replaces the node's copy
+func (connection *Connection) RequestSyncFile(object *index.Index, uuid string) error {
+	file := object.Name
+	partialPath := PartialPath(file)
+	offset := resumeOffset(partialPath, object)
+	//The whole file was downloaded before, but didn't make it into place
+	if offset > 0 && offset == object.Size {
+		err := commitPartial(partialPath, object)
+		if _, mismatch := err.(*ChecksumError); mismatch == false {
+			return err
+		}
+		log.Warnf("Download of %s doesn't match its checksum, fetching the whole file again", file)
+		offset = 0
+	}
+
+	queryValues := make(map[string]string)
+	queryValues["grab"] = file
+	queryValues["uuid"] = uuid
+	//Fetching by checksum makes sure what we get is the version of the file we compared against
+	byChecksum := object.Checksum != "" && atomic.LoadInt32(&connection.noBlobs) == 0
+	endpoint := "/sync"
+	if byChecksum == true {
+		endpoint = "/blob/" + url.PathEscape(object.Checksum)
+	}
+	request := connection.ConstructGetRequest(endpoint, queryValues)
+	if offset > 0 {
+		request.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		request.Header.Set("If-Range", `"`+object.Checksum+`"`)
+	}
+	response, err := connection.do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	switch response.StatusCode {
+	case http.StatusPartialContent:
+		start, err := contentRangeStart(response.Header.Get("Content-Range"))
 		if err != nil {
 			return err
 		}
+		if start != offset {
+			return fmt.Errorf("Server resumed %s at byte %d, expected %d", file, start, offset)
+		}
+		log.Infof("Resuming %s at byte %d of %d", file, offset, object.Size)
+		flags |= os.O_APPEND
+	case http.StatusOK:
+		//The server sent the whole file, either because we asked for it or the file changed
+		flags |= os.O_TRUNC
+	case http.StatusNotFound:
+		if byChecksum == false {
+			return connection.HandleAPIError(response, http.StatusOK)
+		}
+		//Servers that predate blobs only serve files by path
+		atomic.StoreInt32(&connection.noBlobs, 1)
+		response.Body.Close()
+		return connection.RequestSyncFile(object, uuid)
+	case http.StatusGone, http.StatusConflict:
+		return &StaleError{Name: file, Err: connection.HandleAPIError(response, http.StatusOK)}
+	case http.StatusRequestedRangeNotSatisfiable:
+		//The server's copy doesn't go past what we have, so what we have is useless
+		response.Body.Close()
+		discardPartial(partialPath)
+		if offset == 0 {
+			return fmt.Errorf("Server can't serve %s from the start", file)
+		}
+		return connection.RequestSyncFile(object, uuid)
+	default:
+		return connection.HandleAPIError(response, http.StatusOK)
 	}
-	return utils.WriteFile(dir, reader)
+
+	//make sure we create the directory tree if it's needed
+	if err := os.MkdirAll(path.Dir(file), 0777); err != nil {
+		return err
+	}
+	serial, err := json.Marshal(&partialState{Checksum: object.Checksum, Size: object.Size})
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(partialPath+".json", serial, 0644); err != nil {
+		return err
+	}
+	partial, err := os.OpenFile(partialPath, flags, 0644)
+	if err != nil {
+		return err
+	}
+	reader, err := InflateReader(response)
+	if err != nil {
+		partial.Close()
+		return err
+	}
+	defer reader.Close()
+	_, err = io.Copy(partial, reader)
+	if closeErr := partial.Close(); err == nil {
+		err = closeErr
+	}
+	//Leave the partial file where it is, so we can resume later
+	if err != nil {
+		return err
+	}
+	return commitPartial(partialPath, object)
 }
 
-func (connection *Connection) RequestSyncFile(file string, uuid string) error {
+//RequestDeltaFile updates the node's copy of object by sending the server the signature of
+//the blocks it already has, and rebuilding the file from the delta the server answers with.
+//The rebuilt file is checked against the checksum in object before it replaces the node's copy
+func (connection *Connection) RequestDeltaFile(object *index.Index, uuid string) error {
+	file := object.Name
+	base, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer base.Close()
+	info, err := base.Stat()
+	if err != nil {
+		return err
+	}
+	blockSize := delta.BlockSizeFor(info.Size())
+	signature, err := delta.GenerateSignature(base, blockSize)
+	if err != nil {
+		return err
+	}
+
 	queryValues := make(map[string]string)
 	queryValues["grab"] = file
 	queryValues["uuid"] = uuid
-	buffer, err := connection.Get("/sync", http.StatusOK, queryValues)
+	reader, err := connection.PostStream("/delta", http.StatusOK, signature, queryValues)
 	if err != nil {
 		return err
 	}
-	reader := bytes.NewReader(buffer)
-	return utils.WriteFile(file, reader)
+	defer reader.Close()
+
+	//The old copy is read while the new one is written, so rebuild it next to the old one
+	//and move it into place when it's done
+	rebuilt, err := utils.TempFile(file)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(rebuilt.Name())
+	err = delta.ApplyDelta(base, blockSize, reader, rebuilt)
+	if closeErr := rebuilt.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := VerifyChecksum(file, rebuilt.Name(), object.Checksum, object.Algorithm); err != nil {
+		return err
+	}
+	if err := utils.SetMetadata(rebuilt.Name(), object.Mode, object.ModTime, object.UID, object.GID); err != nil {
+		return err
+	}
+	return utils.CommitFile(rebuilt.Name(), file)
 }
 
-//Identify with a server and tell it the node's version and uuid
-func (connection *Connection) IdentifyWithServer(version string, uuid string, target string) ([]byte, error) {
+//Identify with a server and tell it the node's version, uuid and the hash algorithms it supports,
+//in order of preference. connection.Algorithm is set to the one the server chose. joinToken is only
+//needed to enroll with servers that require one
+func (connection *Connection) IdentifyWithServer(version string, uuid string, target string, algorithms []string,
+	joinToken string) error {
 	metaData := &nodelist.NodeMetadata{
-		Version: version,
-		UUID:    uuid,
-		Target:  target,
+		Version:    version,
+		UUID:       uuid,
+		Target:     target,
+		Algorithms: algorithms,
+		JoinToken:  joinToken,
 	}
-	return connection.Post("/identify", http.StatusOK, &metaData)
+	serial, err := connection.Post("/identify", http.StatusOK, &metaData)
+	if err != nil {
+		return err
+	}
+	//Servers that predate the choice don't send a response, and only use the default
+	connection.Algorithm = index.DefaultAlgorithm
+	if len(bytes.TrimSpace(serial)) == 0 {
+		return nil
+	}
+	var response *nodelist.IdentifyResponse
+	if err := json.Unmarshal(serial, &response); err != nil {
+		return err
+	}
+	if response == nil {
+		return nil
+	}
+	if response.Algorithm != "" {
+		connection.Algorithm = response.Algorithm
+	}
+	//Only sent when the node enrolls, from then on every request is signed with it
+	if response.Secret != "" {
+		connection.NodeUUID = uuid
+		connection.Secret = response.Secret
+	}
+	if response.Status == nodelist.StatusPending {
+		log.Warnf("Server (%s) holds the node for approval, nothing will be synced from it until then",
+			connection.Address)
+	}
+	return nil
 }
 
 //Send a heartbeat to a server, updating the node's synced status
@@ -0,0 +1,99 @@
+package connection_test
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/tywkeene/autobd/connection"
+	"github.com/tywkeene/autobd/index"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+//newObject writes content to a file in dir, and returns its index entry for name in dir
+func newObject(t *testing.T, dir string, name string, content []byte) *index.Index {
+	source := path.Join(dir, "source")
+	if err := ioutil.WriteFile(source, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(source)
+	return &index.Index{
+		Name:     path.Join(dir, name),
+		Checksum: index.GetChecksum(source),
+		Size:     int64(len(content)),
+		ModTime:  time.Now(),
+		Mode:     0644,
+		UID:      os.Getuid(),
+		GID:      os.Getgid(),
+	}
+}
+
+//writePartial leaves a partial download of object holding content, as an interrupted transfer would
+func writePartial(t *testing.T, object *index.Index, content []byte) {
+	partialPath := connection.PartialPath(object.Name)
+	if err := ioutil.WriteFile(partialPath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	state := fmt.Sprintf(`{"checksum": "%s", "size": %d}`, object.Checksum, object.Size)
+	if err := ioutil.WriteFile(partialPath+".json", []byte(state), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//Ensure a partial download that's already complete is moved into place without asking the server
+//for the range past its end, and a broken one is downloaded again from the start
+func TestRequestSyncFileComplete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-connection")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	content := []byte("the whole file was downloaded before the node was stopped")
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("Range") != "" {
+			//Nothing lies past the end of the file
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		w.Write(content)
+	}))
+	defer server.Close()
+	client := connection.NewConnection(server.URL, "test", nil)
+
+	check := func(object *index.Index, expectRequests int) {
+		if err := client.RequestSyncFile(object, "test"); err != nil {
+			t.Fatal(err)
+		}
+		synced, err := ioutil.ReadFile(object.Name)
+		if err != nil || bytes.Equal(synced, content) == false {
+			t.Errorf("%s wasn't synced: %v", object.Name, err)
+		}
+		if _, err := os.Stat(connection.PartialPath(object.Name) + ".json"); os.IsNotExist(err) == false {
+			t.Errorf("Partial download of %s wasn't cleaned up", object.Name)
+		}
+		if requests != expectRequests {
+			t.Errorf("Syncing %s took %d requests, expected %d", object.Name, requests, expectRequests)
+		}
+		requests = 0
+	}
+
+	complete := newObject(t, dir, "complete", content)
+	writePartial(t, complete, content)
+	check(complete, 0)
+
+	broken := newObject(t, dir, "broken", content)
+	writePartial(t, broken, bytes.Repeat([]byte("x"), len(content)))
+	check(broken, 1)
+
+	//The server refuses to resume, so the partial download is thrown away
+	refused := newObject(t, dir, "refused", content)
+	writePartial(t, refused, content[:10])
+	check(refused, 2)
+}
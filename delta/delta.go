@@ -0,0 +1,280 @@
+//Package delta implements rsync style block level delta transfers. The node sends the
+//signature of its copy of a file, the server answers with a stream of instructions that
+//either copy a block the node already has or carry literal data, and the node rebuilds
+//the new file from those instructions and its old copy
+package delta
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"math"
+)
+
+//Smallest block size used for signatures, files smaller than this aren't worth a delta
+const MinBlockSize = 8 * 1024
+
+//Largest block size used for signatures
+const MaxBlockSize = 1024 * 1024
+
+//Literal data is flushed to the node in chunks of at most this size
+const maxLiteral = 256 * 1024
+
+const (
+	OpCopy = iota
+	OpLiteral
+)
+
+//BlockSignature describes one block of the node's copy of a file
+type BlockSignature struct {
+	Weak   uint32 `json:"weak"`   //Rolling checksum of the block
+	Strong []byte `json:"strong"` //SHA256 of the block
+	Size   int    `json:"size"`   //Size of the block, only the last block may be smaller than BlockSize
+}
+
+//Signature describes the node's copy of a file as a list of block checksums
+type Signature struct {
+	BlockSize int              `json:"block_size"`
+	Blocks    []BlockSignature `json:"blocks"`
+}
+
+//Instruction is a single step in rebuilding a file. OpCopy copies Count blocks from the node's
+//copy starting at Block, OpLiteral writes Data as-is
+type Instruction struct {
+	Op    int    `json:"op"`
+	Block int    `json:"block,omitempty"`
+	Count int    `json:"count,omitempty"`
+	Data  []byte `json:"data,omitempty"`
+}
+
+//BlockSizeFor picks a block size for a file of size bytes. Like rsync it grows with the
+//square root of the size, so the signature of a large file stays small
+func BlockSizeFor(size int64) int {
+	blockSize := int(math.Sqrt(float64(size)))
+	blockSize = (blockSize + 1023) &^ 1023
+	if blockSize < MinBlockSize {
+		return MinBlockSize
+	}
+	if blockSize > MaxBlockSize {
+		return MaxBlockSize
+	}
+	return blockSize
+}
+
+//rolling is the rsync weak checksum over a window of bytes, which can be moved forward
+//one byte at a time without rereading the window
+type rolling struct {
+	a, b   uint32
+	window uint32
+}
+
+func newRolling(block []byte) *rolling {
+	r := &rolling{window: uint32(len(block))}
+	for i, c := range block {
+		r.a += uint32(c)
+		r.b += uint32(len(block)-i) * uint32(c)
+	}
+	return r
+}
+
+//roll removes out from the start of the window and adds in at the end
+func (r *rolling) roll(out byte, in byte) {
+	r.a += uint32(in) - uint32(out)
+	r.b += r.a - r.window*uint32(out)
+}
+
+func (r *rolling) sum() uint32 {
+	return (r.a & 0xffff) | (r.b << 16)
+}
+
+func strongSum(block []byte) []byte {
+	sum := sha256.Sum256(block)
+	return sum[:]
+}
+
+//GenerateSignature reads source and returns the signature of its blocks
+func GenerateSignature(source io.Reader, blockSize int) (*Signature, error) {
+	signature := &Signature{BlockSize: blockSize, Blocks: make([]BlockSignature, 0)}
+	reader := bufio.NewReaderSize(source, blockSize)
+	block := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(reader, block)
+		if n > 0 {
+			signature.Blocks = append(signature.Blocks, BlockSignature{
+				Weak:   newRolling(block[:n]).sum(),
+				Strong: strongSum(block[:n]),
+				Size:   n,
+			})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return signature, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+//encoder merges runs of consecutive block copies into a single instruction before
+//handing them to emit
+type encoder struct {
+	pending *Instruction
+	emit    func(*Instruction) error
+}
+
+func (e *encoder) flush() error {
+	if e.pending == nil {
+		return nil
+	}
+	pending := e.pending
+	e.pending = nil
+	return e.emit(pending)
+}
+
+func (e *encoder) copyBlock(block int) error {
+	if e.pending != nil && e.pending.Op == OpCopy && e.pending.Block+e.pending.Count == block {
+		e.pending.Count++
+		return nil
+	}
+	if err := e.flush(); err != nil {
+		return err
+	}
+	e.pending = &Instruction{Op: OpCopy, Block: block, Count: 1}
+	return nil
+}
+
+func (e *encoder) literal(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if err := e.flush(); err != nil {
+		return err
+	}
+	//data points into the scanning buffer, which is reused
+	return e.emit(&Instruction{Op: OpLiteral, Data: append([]byte(nil), data...)})
+}
+
+//ComputeDelta reads source and calls emit with the instructions that rebuild it from the
+//file described by signature. Memory use is bounded by the block size, not the file size
+func ComputeDelta(signature *Signature, source io.Reader, emit func(*Instruction) error) error {
+	blockSize := signature.BlockSize
+	blocks := make(map[uint32][]int)
+	for i, block := range signature.Blocks {
+		blocks[block.Weak] = append(blocks[block.Weak], i)
+	}
+	out := &encoder{emit: emit}
+
+	buffer := make([]byte, 0, maxLiteral+2*blockSize+1)
+	var literalStart, offset int
+	var eof bool
+
+	//fill makes sure want bytes from offset are buffered, unless source runs out first
+	fill := func(want int) error {
+		for eof == false && len(buffer)-offset < want {
+			if len(buffer) == cap(buffer) {
+				if offset-literalStart >= maxLiteral {
+					if err := out.literal(buffer[literalStart:offset]); err != nil {
+						return err
+					}
+					literalStart = offset
+				}
+				kept := copy(buffer, buffer[literalStart:])
+				buffer = buffer[:kept]
+				offset -= literalStart
+				literalStart = 0
+			}
+			n, err := source.Read(buffer[len(buffer):cap(buffer)])
+			buffer = buffer[:len(buffer)+n]
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var weak *rolling
+	for {
+		if err := fill(blockSize + 1); err != nil {
+			return err
+		}
+		size := len(buffer) - offset
+		if size == 0 {
+			break
+		}
+		if size > blockSize {
+			size = blockSize
+		}
+		if weak == nil {
+			weak = newRolling(buffer[offset : offset+size])
+		}
+
+		matched := -1
+		if candidates, ok := blocks[weak.sum()]; ok == true {
+			strong := strongSum(buffer[offset : offset+size])
+			for _, candidate := range candidates {
+				if signature.Blocks[candidate].Size == size && bytes.Equal(signature.Blocks[candidate].Strong, strong) {
+					matched = candidate
+					break
+				}
+			}
+		}
+		if matched >= 0 {
+			if err := out.literal(buffer[literalStart:offset]); err != nil {
+				return err
+			}
+			if err := out.copyBlock(matched); err != nil {
+				return err
+			}
+			offset += size
+			literalStart = offset
+			weak = nil
+			continue
+		}
+		//Less than a full block is left, so nothing further along can match
+		if size < blockSize {
+			offset = len(buffer)
+			break
+		}
+		if offset+size < len(buffer) {
+			weak.roll(buffer[offset], buffer[offset+size])
+		} else {
+			weak = nil
+		}
+		offset++
+	}
+	if err := out.literal(buffer[literalStart:offset]); err != nil {
+		return err
+	}
+	return out.flush()
+}
+
+//ApplyDelta reads instructions from source and writes the rebuilt file to dest, copying
+//blocks from base where instructed
+func ApplyDelta(base io.ReaderAt, blockSize int, source io.Reader, dest io.Writer) error {
+	decoder := json.NewDecoder(source)
+	for {
+		var instruction Instruction
+		if err := decoder.Decode(&instruction); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		switch instruction.Op {
+		case OpCopy:
+			start := int64(instruction.Block) * int64(blockSize)
+			length := int64(instruction.Count) * int64(blockSize)
+			section := io.NewSectionReader(base, start, length)
+			if _, err := io.Copy(dest, section); err != nil {
+				return err
+			}
+		case OpLiteral:
+			if _, err := dest.Write(instruction.Data); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package delta_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/tywkeene/autobd/delta"
+	"math/rand"
+	"testing"
+)
+
+//roundTrip computes the delta from old to new and applies it, returning the rebuilt
+//file and the number of literal bytes that were sent
+func roundTrip(t *testing.T, old []byte, new []byte, blockSize int) ([]byte, int) {
+	signature, err := delta.GenerateSignature(bytes.NewReader(old), blockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stream bytes.Buffer
+	var literal int
+	encoder := json.NewEncoder(&stream)
+	err = delta.ComputeDelta(signature, bytes.NewReader(new), func(instruction *delta.Instruction) error {
+		literal += len(instruction.Data)
+		return encoder.Encode(instruction)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rebuilt bytes.Buffer
+	if err := delta.ApplyDelta(bytes.NewReader(old), blockSize, &stream, &rebuilt); err != nil {
+		t.Fatal(err)
+	}
+	return rebuilt.Bytes(), literal
+}
+
+func randomBytes(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	return data
+}
+
+func TestDelta(t *testing.T) {
+	const blockSize = delta.MinBlockSize
+	old := randomBytes(blockSize*50 + 123)
+
+	appended := append(append([]byte(nil), old...), randomBytes(5000)...)
+	inserted := append(append(append([]byte(nil), old[:blockSize*10+7]...), []byte("inserted")...),
+		old[blockSize*10+7:]...)
+	truncated := old[:blockSize*20]
+
+	var table = []struct {
+		Name       string
+		New        []byte
+		MaxLiteral int //The most literal data the delta should need
+	}{
+		{"identical", old, 0},
+		{"appended", appended, 5000 + blockSize},
+		{"inserted", inserted, 2 * blockSize},
+		{"truncated", truncated, 0},
+		{"unrelated", randomBytes(blockSize * 3), blockSize * 3},
+		{"empty", []byte{}, 0},
+	}
+	for _, test := range table {
+		rebuilt, literal := roundTrip(t, old, test.New, blockSize)
+		if bytes.Equal(rebuilt, test.New) == false {
+			t.Errorf("%s: rebuilt file does not match", test.Name)
+		}
+		if literal > test.MaxLiteral {
+			t.Errorf("%s: sent %d literal bytes, expected at most %d", test.Name, literal, test.MaxLiteral)
+		}
+	}
+}
+
+func TestDeltaFromEmpty(t *testing.T) {
+	new := randomBytes(delta.MinBlockSize*2 + 1)
+	rebuilt, _ := roundTrip(t, []byte{}, new, delta.MinBlockSize)
+	if bytes.Equal(rebuilt, new) == false {
+		t.Error("rebuilt file does not match")
+	}
+}
@@ -0,0 +1,238 @@
+//Package ignore implements gitignore style exclusion rules for the served tree. Rules come
+//from the ignore list in the configuration, and from ignore files in the tree itself, which
+//apply to everything below the directory they're in
+package ignore
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/tywkeene/autobd/options"
+	"github.com/tywkeene/autobd/utils"
+)
+
+//pattern is a single line of an ignore file
+type pattern struct {
+	expr    *regexp.Regexp
+	base    string //Directory the pattern is relative to
+	negate  bool   //The pattern re-includes what an earlier pattern excluded
+	dirOnly bool   //The pattern only matches directories
+	builtin bool   //One of autobd's own files, which no pattern can re-include
+}
+
+//Rules is the list of patterns in effect for a directory, in the order they're applied
+type Rules struct {
+	patterns []*pattern
+}
+
+//compile translates a gitignore glob into a regular expression. "*" and "?" don't match
+//across directories, "**" does
+func compile(glob string, anchored bool) (*regexp.Regexp, error) {
+	var expr bytes.Buffer
+	expr.WriteString("^")
+	if anchored == false {
+		expr.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(glob); i++ {
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			expr.WriteString("(?:.*/)?")
+			i += 2
+		case glob[i:] == "/**":
+			expr.WriteString("/.+")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			expr.WriteString(".*")
+			i++
+		case glob[i] == '*':
+			expr.WriteString("[^/]*")
+		case glob[i] == '?':
+			expr.WriteString("[^/]")
+		case glob[i] == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				expr.WriteString(regexp.QuoteMeta("["))
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end + 1
+		case glob[i] == '\\' && i+1 < len(glob):
+			expr.WriteString(regexp.QuoteMeta(glob[i+1 : i+2]))
+			i++
+		default:
+			expr.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.Compile(expr.String())
+}
+
+//parse parses a single line of an ignore file found in the directory base. Returns nil for
+//blank lines, comments and invalid patterns
+func parse(base string, line string) *pattern {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil
+	}
+	p := &pattern{base: base}
+	if strings.HasPrefix(line, "!") {
+		p.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	//A slash anywhere but the end ties the pattern to base, otherwise it matches at any depth
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if line == "" {
+		return nil
+	}
+	expr, err := compile(line, anchored)
+	if utils.HandleError(err, utils.ErrorActionWarn) == true {
+		return nil
+	}
+	p.expr = expr
+	return p
+}
+
+//builtin returns the pattern excluding name, one of autobd's own files. It only matches name itself,
+//relative to the root of the tree, which is the working directory, so files elsewhere in the tree with
+//the same base name are left alone. Returns nil if name isn't inside of the tree
+func builtin(name string) *pattern {
+	root, err := filepath.Abs(".")
+	if err != nil {
+		return nil
+	}
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return nil
+	}
+	relative, err := filepath.Rel(root, abs)
+	if err != nil || relative == "." || relative == ".." || strings.HasPrefix(relative, "../") == true {
+		return nil
+	}
+	return &pattern{
+		expr:    regexp.MustCompile("^" + regexp.QuoteMeta(filepath.ToSlash(relative)) + "$"),
+		base:    ".",
+		builtin: true,
+	}
+}
+
+//New returns the rules that apply to the whole tree: autobd's own files, and the patterns
+//in the ignore list of the configuration
+func New() *Rules {
+	rules := &Rules{patterns: make([]*pattern, 0)}
+	for _, name := range []string{options.Config.NodeListFile, options.Config.IndexStateFile, options.Config.TLSDirectory,
+		options.Config.JoinTokensFile} {
+		if name == "" {
+			continue
+		}
+		if p := builtin(name); p != nil {
+			rules.patterns = append(rules.patterns, p)
+		}
+	}
+	for _, line := range options.Config.Ignore {
+		if p := parse(".", line); p != nil {
+			rules.patterns = append(rules.patterns, p)
+		}
+	}
+	return rules
+}
+
+//Load returns the rules in effect inside of dirPath, which are these rules followed by the
+//patterns in dirPath's ignore file, if it has one
+func (rules *Rules) Load(dirPath string) *Rules {
+	dirPath = path.Clean(dirPath)
+	if options.Config.IgnoreFile == "" {
+		return rules
+	}
+	file, err := os.Open(path.Join(dirPath, options.Config.IgnoreFile))
+	if os.IsNotExist(err) == true {
+		return rules
+	} else if utils.HandleError(err, utils.ErrorActionWarn) == true {
+		return rules
+	}
+	defer file.Close()
+
+	loaded := &Rules{patterns: append([]*pattern(nil), rules.patterns...)}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if p := parse(dirPath, scanner.Text()); p != nil {
+			loaded.patterns = append(loaded.patterns, p)
+		}
+	}
+	utils.HandleError(scanner.Err(), utils.ErrorActionWarn)
+	return loaded
+}
+
+//Match reports whether name is ignored. Later patterns take precedence over earlier ones,
+//so a negated pattern can re-include a file excluded before it, unless it's one of autobd's own files
+func (rules *Rules) Match(name string, isDir bool) bool {
+	name = path.Clean(name)
+	ignored := false
+	for _, p := range rules.patterns {
+		if p.dirOnly == true && isDir == false {
+			continue
+		}
+		relative := name
+		if p.base != "." {
+			if strings.HasPrefix(name, p.base+"/") == false {
+				continue
+			}
+			relative = strings.TrimPrefix(name, p.base+"/")
+		}
+		if p.expr.MatchString(relative) == true {
+			if p.builtin == true {
+				return true
+			}
+			ignored = p.negate == false
+		}
+	}
+	return ignored
+}
+
+//For returns the rules in effect inside of the directory dirPath, collecting the ignore files
+//from the root down to it. Also reports whether dirPath, or one of its parents, is ignored
+func For(dirPath string) (*Rules, bool) {
+	rules := New().Load(".")
+	dirPath = path.Clean(dirPath)
+	if dirPath == "." || dirPath == "/" {
+		return rules, false
+	}
+	var walked string
+	for _, element := range strings.Split(dirPath, "/") {
+		walked = path.Join(walked, element)
+		if rules.Match(walked, true) == true {
+			return rules, true
+		}
+		rules = rules.Load(walked)
+	}
+	return rules, false
+}
+
+//Ignored reports whether the file or directory at name is ignored
+func Ignored(name string) bool {
+	name = path.Clean(name)
+	if name == "." {
+		return false
+	}
+	rules, ignored := For(path.Dir(name))
+	if ignored == true {
+		return true
+	}
+	info, err := os.Lstat(name)
+	return rules.Match(name, err == nil && info.IsDir())
+}
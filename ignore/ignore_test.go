@@ -0,0 +1,73 @@
+package ignore_test
+
+import (
+	"github.com/tywkeene/autobd/ignore"
+	"github.com/tywkeene/autobd/options"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-ignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	options.Config.IgnoreFile = ".autobdignore"
+	options.Config.NodeListFile = ".nodes"
+	options.Config.TLSDirectory = "tls"
+	options.Config.JoinTokensFile = "/etc/autobd/.tokens"
+	options.Config.Ignore = []string{"*.sock"}
+	os.MkdirAll("src/build", 0755)
+	ioutil.WriteFile(".autobdignore", []byte("# comment\n*.o\n!keep.o\nbuild/\n/top\ndocs/**/*.tmp\n!.nodes\n!tls/\n"), 0644)
+	ioutil.WriteFile("src/.autobdignore", []byte("*.log\n!keep.o\nlocal\n"), 0644)
+
+	var table = []struct {
+		Name    string
+		IsDir   bool
+		Ignored bool
+	}{
+		{"a.o", false, true},
+		{"src/deep/b.o", false, true},
+		{"keep.o", false, false},
+		{"build", true, true},
+		{"build", false, false},
+		{"src/build", true, true},
+		{"top", false, true},
+		{"src/top", false, false},
+		{"docs/x.tmp", false, true},
+		{"docs/a/b/x.tmp", false, true},
+		{"x.tmp", false, false},
+		{"server.sock", false, true},
+		{".nodes", false, true},
+		{"tls", true, true},
+		{"src/.nodes", false, false},
+		{"src/tls", true, false},
+		{".tokens", false, false},
+		{"a.log", false, false},
+		{"src/a.log", false, true},
+		{"src/local", false, true},
+		{"local", false, false},
+	}
+	for _, test := range table {
+		rules, ignored := ignore.For(path.Dir(test.Name))
+		if ignored == true {
+			t.Errorf("%s: parent directory unexpectedly ignored", test.Name)
+			continue
+		}
+		if rules.Match(test.Name, test.IsDir) != test.Ignored {
+			t.Errorf("%s: expected ignored to be %v", test.Name, test.Ignored)
+		}
+	}
+	if _, ignored := ignore.For("src/build/obj"); ignored == false {
+		t.Error("Expected the contents of an ignored directory to be ignored")
+	}
+}
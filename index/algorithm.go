@@ -0,0 +1,55 @@
+package index
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"hash"
+	"hash/crc64"
+	"sort"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+//The algorithm used when none is chosen, and by servers that predate the choice
+const DefaultAlgorithm = "sha512"
+
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
+//algorithms maps the name of each supported hash algorithm to its constructor. crc64 isn't
+//cryptographic, it only detects changes, but it's much faster than the others
+var algorithms = map[string]func() hash.Hash{
+	"sha512": sha512.New,
+	"sha256": sha256.New,
+	"blake2b": func() hash.Hash {
+		hash, _ := blake2b.New512(nil)
+		return hash
+	},
+	"crc64": func() hash.Hash {
+		return crc64.New(crc64Table)
+	},
+}
+
+//Algorithms returns the names of the supported hash algorithms
+func Algorithms() []string {
+	names := make([]string, 0, len(algorithms))
+	for name := range algorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//SupportedAlgorithm reports whether algorithm is the name of a supported hash algorithm
+func SupportedAlgorithm(algorithm string) bool {
+	_, ok := algorithms[algorithm]
+	return ok
+}
+
+//NewHash returns a new hash.Hash for algorithm, falling back to DefaultAlgorithm if
+//algorithm is empty or unsupported
+func NewHash(algorithm string) hash.Hash {
+	if constructor, ok := algorithms[algorithm]; ok == true {
+		return constructor()
+	}
+	return algorithms[DefaultAlgorithm]()
+}
@@ -0,0 +1,25 @@
+package index
+
+//Kinds of changes recorded in the server's change journal
+const (
+	EventCreate = "create"
+	EventModify = "modify"
+	EventDelete = "delete"
+)
+
+//Change is a file or directory that was created, modified or deleted on the server
+type Change struct {
+	Sequence uint64 `json:"sequence"`
+	Event    string `json:"event"`
+	Name     string `json:"name"`
+	IsDir    bool   `json:"is_dir"`
+}
+
+//ChangeSet is what a node gets when it asks for the changes since a sequence number. If the journal
+//no longer goes back that far, or was restarted, Index is set to the whole tree instead
+type ChangeSet struct {
+	Journal  string            `json:"journal"`  //Identifies the journal, sequence numbers only mean something within it
+	Sequence uint64            `json:"sequence"` //Sequence number of the latest change
+	Changes  []Change          `json:"changes"`
+	Index    map[string]*Index `json:"index,omitempty"`
+}
@@ -0,0 +1,11 @@
+// +build linux
+
+package index
+
+import (
+	"syscall"
+)
+
+func statChangeTime(stat *syscall.Stat_t) int64 {
+	return stat.Ctim.Nano()
+}
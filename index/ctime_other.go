@@ -0,0 +1,12 @@
+// +build !linux,!windows,!plan9
+
+package index
+
+import (
+	"syscall"
+)
+
+//The change time isn't looked up on this platform, the rest of the stat data still is
+func statChangeTime(stat *syscall.Stat_t) int64 {
+	return 0
+}
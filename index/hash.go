@@ -0,0 +1,96 @@
+package index
+
+import (
+	"os"
+	"runtime"
+	"sync"
+
+	"github.com/tywkeene/autobd/ignore"
+	"github.com/tywkeene/autobd/options"
+	"github.com/tywkeene/autobd/throttle"
+	"github.com/tywkeene/autobd/utils"
+)
+
+//Shared by all the hashing workers, so indexing as a whole stays under options.Config.HashRate
+var hashLimiter *throttle.Limiter
+var hashLimiterOnce = sync.Once{}
+
+func getHashLimiter() *throttle.Limiter {
+	hashLimiterOnce.Do(func() {
+		rate, err := throttle.ParseRate(options.Config.HashRate)
+		if utils.HandleError(err, utils.ErrorActionWarn) == false && rate > 0 {
+			hashLimiter = throttle.NewLimiter(rate)
+		}
+	})
+	return hashLimiter
+}
+
+//hashWorkers returns how many files are hashed at the same time
+func hashWorkers() int {
+	if options.Config.HashWorkers > 0 {
+		return options.Config.HashWorkers
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+//hashJob is a regular file waiting to be hashed
+type hashJob struct {
+	index *Index
+	info  os.FileInfo
+}
+
+//indexer walks a tree and hands the files it finds to a pool of workers to be hashed,
+//so reading directories and hashing files happen at the same time
+type indexer struct {
+	recursive bool
+	algorithm string
+	jobs      chan hashJob
+	pending   sync.WaitGroup
+	dirs      []*Index //Directories whose contents were indexed, children before their parents
+}
+
+func newIndexer(recursive bool, algorithm string) *indexer {
+	if algorithm == "" {
+		algorithm = DefaultAlgorithm
+	}
+	workers := hashWorkers()
+	ix := &indexer{
+		recursive: recursive,
+		algorithm: algorithm,
+		jobs:      make(chan hashJob, workers*4),
+		dirs:      make([]*Index, 0),
+	}
+	for i := 0; i < workers; i++ {
+		go ix.hashWorker()
+	}
+	return ix
+}
+
+func (ix *indexer) hashWorker() {
+	for job := range ix.jobs {
+		job.index.Checksum = checksum(job.index.Name, job.info, ix.algorithm)
+		ix.pending.Done()
+	}
+}
+
+//hash queues the regular file described by index and info to be hashed. Blocks while
+//the workers are busy, so the walk doesn't get too far ahead of them
+func (ix *indexer) hash(index *Index, info os.FileInfo) {
+	ix.pending.Add(1)
+	ix.jobs <- hashJob{index: index, info: info}
+}
+
+//run indexes dirPath, waits for every file in it to be hashed, and then computes the
+//checksums of the directories, which depend on the checksums of their files
+func (ix *indexer) run(dirPath string, previous map[string]*Index, rules *ignore.Rules) (map[string]*Index, error) {
+	files, err := ix.generate(dirPath, previous, rules)
+	close(ix.jobs)
+	ix.pending.Wait()
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range ix.dirs {
+		dir.Checksum = DirChecksum(dir.Files, ix.algorithm)
+	}
+	return files, nil
+}
@@ -2,15 +2,17 @@ package index
 
 import (
 	"bufio"
-	"crypto/sha512"
 	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
+	"sort"
 	"time"
 
+	"github.com/tywkeene/autobd/ignore"
 	"github.com/tywkeene/autobd/options"
+	"github.com/tywkeene/autobd/throttle"
 	"github.com/tywkeene/autobd/utils"
 )
 
@@ -18,9 +20,12 @@ import (
 type Index struct {
 	//Name is the filename of the file or directory indexed
 	Name string `json:"name"`
-	//Checksum is the checksum of the file, empty if filetype is a directory
-	//Empty if directory
+	//Checksum is the checksum of the file. For a directory, it's derived from
+	//the checksums and metadata of everything in it, see DirChecksum()
 	Checksum string `json:"checksum,omitempty"`
+	//Algorithm is the hash algorithm Checksum was computed with
+	//Empty for DefaultAlgorithm
+	Algorithm string `json:"algorithm,omitempty"`
 	//Size is the size of the file in bytes
 	Size int64 `json:"size"`
 	//Modtime is the timestamp of the last modification of the file
@@ -29,6 +34,16 @@ type Index struct {
 	Mode os.FileMode `json:"fileMode"`
 	//IsDir is this file a regular file or a directory
 	IsDir bool `json:"isDir"`
+	//UID is the numeric id of the user that owns this file
+	UID int `json:"uid"`
+	//GID is the numeric id of the group that owns this file
+	GID int `json:"gid"`
+	//Link is the target of a symbolic link
+	//Empty if not a symbolic link
+	Link string `json:"link,omitempty"`
+	//LinkGroup is shared by all files that are hard links to the same content
+	//Empty if the file only has one link
+	LinkGroup string `json:"linkGroup,omitempty"`
 	//Files is the files contained in the directory referenced by this structure
 	//Empty if file
 	Files map[string]*Index `json:"files,omitempty"`
@@ -36,6 +51,17 @@ type Index struct {
 
 //GetChecksum returns the SHA512 hash of the file at 'path'.
 func GetChecksum(path string) string {
+	return hashFile(path, DefaultAlgorithm, nil)
+}
+
+//GetChecksumWith returns the hash of the file at 'path', computed with algorithm
+func GetChecksumWith(path string, algorithm string) string {
+	return hashFile(path, algorithm, nil)
+}
+
+//hashFile returns the hash of the file at 'path' computed with algorithm, reading it no
+//faster than limiter allows
+func hashFile(path string, algorithm string, limiter *throttle.Limiter) string {
 	defer utils.TimeTrack(time.Now(), "index/GetChecksum()")
 	file, err := os.Open(path)
 	if utils.HandleError(err, utils.ErrorActionErr) == true {
@@ -43,8 +69,8 @@ func GetChecksum(path string) string {
 	}
 	defer file.Close()
 
-	hash := sha512.New()
-	buf := bufio.NewReader(file)
+	hash := NewHash(algorithm)
+	buf := bufio.NewReader(throttle.Reader(file, limiter))
 
 	_, err = buf.WriteTo(hash)
 	if utils.HandleError(err, utils.ErrorActionErr) == true {
@@ -62,35 +88,173 @@ func NewIndex(name string, size int64, modtime time.Time, mode os.FileMode, isDi
 	} else {
 		checksum = ""
 	}
-	return &Index{name, checksum, size, modtime, mode, isDir, nil}
+	return &Index{
+		Name:     name,
+		Checksum: checksum,
+		Size:     size,
+		ModTime:  modtime,
+		Mode:     mode,
+		IsDir:    isDir,
+	}
+}
+
+//newIndexFromInfo returns the index of the file at name, described by info, without its checksum.
+//Symbolic links are recorded with their target instead of being followed
+func newIndexFromInfo(name string, info os.FileInfo) *Index {
+	index := &Index{
+		Name:    name,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Mode:    info.Mode(),
+		IsDir:   info.IsDir(),
+	}
+	index.UID, index.GID = fileOwner(info)
+	if info.Mode()&os.ModeSymlink != 0 {
+		link, err := os.Readlink(name)
+		utils.HandleError(err, utils.ErrorActionErr)
+		index.Link = link
+	} else if info.Mode().IsRegular() == true {
+		index.LinkGroup = FileLinkGroup(info)
+	}
+	return index
+}
+
+//skipLink reports whether the symbolic link at name should be left out of the index,
+//because it points outside of the tree and the symlink policy says to skip those
+func skipLink(name string, info os.FileInfo) bool {
+	if info.Mode()&os.ModeSymlink == 0 || options.Config.SymlinkPolicy != options.SymlinkPolicySkip {
+		return false
+	}
+	link, err := os.Readlink(name)
+	return err != nil || utils.LinkEscapes(name, link) == true
 }
 
 //GenerateIndex Recursively genearates an index for dirPath, and returns a map of
-//the directory tree, indexed by filepath
+//the directory tree, indexed by filepath. Files matched by the ignore rules are left out
 func GenerateIndex(dirPath string) (map[string]*Index, error) {
+	return GenerateIndexWith(dirPath, DefaultAlgorithm)
+}
+
+//GenerateIndexWith is GenerateIndex, hashing files with algorithm
+func GenerateIndexWith(dirPath string, algorithm string) (map[string]*Index, error) {
 	defer utils.TimeTrack(time.Now(), "index/GenerateIndex()")
+	rules, _ := ignore.For(dirPath)
+	return newIndexer(true, algorithm).run(dirPath, nil, rules)
+}
+
+//UpdateIndex regenerates the index for dirPath, reusing the checksums in previous for
+//files whose size and modification time haven't changed, so only changed files are rehashed.
+//If recursive is false, subdirectories that already exist in previous keep their contents.
+//previous must have been generated with algorithm
+func UpdateIndex(dirPath string, previous map[string]*Index, recursive bool,
+	algorithm string) (map[string]*Index, error) {
+	defer utils.TimeTrack(time.Now(), "index/UpdateIndex()")
+	rules, _ := ignore.For(dirPath)
+	return newIndexer(recursive, algorithm).run(dirPath, previous, rules)
+}
+
+//unchanged reports whether the file described by info still matches old
+func unchanged(old *Index, info os.FileInfo) bool {
+	if old == nil || old.IsDir != info.IsDir() || old.Size != info.Size() ||
+		old.ModTime.Equal(info.ModTime()) == false || old.Mode != info.Mode() {
+		return false
+	}
+	uid, gid := fileOwner(info)
+	return old.UID == uid && old.GID == gid && old.LinkGroup == FileLinkGroup(info)
+}
+
+//generate indexes dirPath, leaving out what rules, the ignore rules in effect inside of it, match.
+//Regular files are handed to the hashing workers, and directories are left without their checksums
+func (ix *indexer) generate(dirPath string, previous map[string]*Index,
+	rules *ignore.Rules) (map[string]*Index, error) {
 	list, err := ioutil.ReadDir(dirPath)
 	if err != nil {
 		return nil, err
 	}
 	index := make(map[string]*Index)
 	for _, child := range list {
-		if child.Name() == options.Config.NodeListFile {
+		childPath := path.Join(dirPath, child.Name())
+		if rules.Match(childPath, child.IsDir()) == true || skipLink(childPath, child) == true {
 			continue
 		}
-		childPath := path.Join(dirPath, child.Name())
-		index[childPath] = NewIndex(childPath, child.Size(), child.ModTime(), child.Mode(), child.IsDir())
+		old := previous[childPath]
+		if child.IsDir() == false && unchanged(old, child) == true {
+			index[childPath] = old
+			continue
+		}
+		index[childPath] = newIndexFromInfo(childPath, child)
+		if ix.algorithm != DefaultAlgorithm && (child.IsDir() == true || child.Mode().IsRegular() == true) {
+			index[childPath].Algorithm = ix.algorithm
+		}
+		if child.Mode().IsRegular() == true {
+			ix.hash(index[childPath], child)
+		}
 		if child.IsDir() == true {
-			childContent, err := GenerateIndex(childPath)
+			if ix.recursive == false && old != nil && old.IsDir == true {
+				index[childPath].Files = old.Files
+				index[childPath].Checksum = old.Checksum
+				continue
+			}
+			var oldFiles map[string]*Index
+			if old != nil {
+				oldFiles = old.Files
+			}
+			childContent, err := ix.generate(childPath, oldFiles, rules.Load(childPath))
 			if err != nil {
 				return nil, err
 			}
 			index[childPath].Files = childContent
+			ix.dirs = append(ix.dirs, index[childPath])
 		}
 	}
 	return index, nil
 }
 
+//DirChecksum returns the checksum of a directory containing files, computed with algorithm. It's
+//derived from the names, checksums, link targets, modes and modification times of the files, so
+//two directories with the same checksum have identical trees below them. Ownership is left out,
+//since it's mapped differently on every node, and so is the modification time of symbolic links,
+//which nodes don't sync
+func DirChecksum(files map[string]*Index, algorithm string) string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	hash := NewHash(algorithm)
+	for _, name := range names {
+		file := files[name]
+		modTime := file.ModTime.UnixNano()
+		if file.Link != "" {
+			modTime = 0
+		}
+		fmt.Fprintf(hash, "%s\x00%s\x00%s\x00%o\x00%d\n", path.Base(name), file.Checksum, file.Link,
+			uint32(file.Mode), modTime)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+//Trim returns a copy of files that only goes depth levels deep. The directories at the
+//last level keep their checksums, but not their contents. A depth of 0 or less returns files as-is
+func Trim(files map[string]*Index, depth int) map[string]*Index {
+	if depth <= 0 {
+		return files
+	}
+	trimmed := make(map[string]*Index, len(files))
+	for name, file := range files {
+		copied := *file
+		if copied.IsDir == true {
+			if depth == 1 {
+				copied.Files = nil
+			} else {
+				copied.Files = Trim(file.Files, depth-1)
+			}
+		}
+		trimmed[name] = &copied
+	}
+	return trimmed
+}
+
 func ValidateDirectory(dirPath string) (string, error) {
 	dirStat, err := os.Lstat(dirPath)
 	if err != nil {
@@ -108,10 +272,15 @@ func ValidateDirectory(dirPath string) (string, error) {
 
 //GetIndex validates dirPath, and calls GenerateIndex on it
 func GetIndex(dirPath string) (map[string]*Index, error) {
+	return GetIndexWith(dirPath, DefaultAlgorithm)
+}
+
+//GetIndexWith is GetIndex, hashing files with algorithm
+func GetIndexWith(dirPath string, algorithm string) (map[string]*Index, error) {
 	defer utils.TimeTrack(time.Now(), "index/GetIndex()")
 	validPath, err := ValidateDirectory(dirPath)
 	if err != nil {
 		return nil, err
 	}
-	return GenerateIndex(validPath)
+	return GenerateIndexWith(validPath, algorithm)
 }
@@ -2,7 +2,10 @@ package index_test
 
 import (
 	"github.com/tywkeene/autobd/index"
+	"io/ioutil"
+	"os"
 	"testing"
+	"time"
 )
 
 type expect struct {
@@ -75,3 +78,150 @@ func TestGetIndex(t *testing.T) {
 		t.Log("---------------------------------")
 	}
 }
+
+func TestDirChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+	os.MkdirAll("a/b", 0755)
+	os.MkdirAll("c", 0755)
+	ioutil.WriteFile("a/b/file", []byte("before"), 0644)
+
+	before, err := index.GetIndex("./")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before["a"].Checksum == "" || before["a"].Checksum != index.DirChecksum(before["a"].Files, index.DefaultAlgorithm) {
+		t.Fatal("Directory checksum doesn't match its contents")
+	}
+	ioutil.WriteFile("a/b/file", []byte("after"), 0644)
+	after, err := index.UpdateIndex("./", before, true, index.DefaultAlgorithm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after["a"].Checksum == before["a"].Checksum {
+		t.Error("Changing a file didn't change the checksum of the directories above it")
+	}
+	if after["c"].Checksum != before["c"].Checksum {
+		t.Error("Checksum of an unchanged directory changed")
+	}
+
+	trimmed := index.Trim(after, 1)
+	if trimmed["a"].Files != nil || trimmed["a"].Checksum != after["a"].Checksum || after["a"].Files == nil {
+		t.Error("Trim should drop the contents of directories, and leave the original untouched")
+	}
+}
+
+//Ensure a directory with a symbolic link in it has the same checksum on a node, where the link
+//was created at a different time
+func TestDirChecksumSymlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+	os.MkdirAll("a", 0755)
+	ioutil.WriteFile("a/file", []byte("content"), 0644)
+	if err := os.Symlink("file", "a/link"); err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := index.GetIndex("./")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	os.Remove("a/link")
+	os.Symlink("file", "a/link")
+	os.Chtimes("a", before["a"].ModTime, before["a"].ModTime)
+	after, err := index.UpdateIndex("./", before, true, index.DefaultAlgorithm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after["a"].Files["a/link"].ModTime.Equal(before["a"].Files["a/link"].ModTime) == true {
+		t.Fatal("Recreating the link didn't change its modification time")
+	}
+	if after["a"].Checksum != before["a"].Checksum {
+		t.Error("Checksum of a directory changed with the modification time of a symbolic link in it")
+	}
+}
+
+func TestState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+	ioutil.WriteFile("file", []byte("before"), 0644)
+	info, _ := os.Stat("file")
+
+	if err := index.UseState("state"); err != nil {
+		t.Fatal(err)
+	}
+	before, err := index.GetIndex("./")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := index.SaveState(before); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat("state"); err != nil {
+		t.Fatal("State file wasn't saved:", err)
+	}
+
+	//Same size and modification time, but the change time gives it away
+	ioutil.WriteFile("file", []byte("after!"), 0644)
+	os.Chtimes("file", info.ModTime(), info.ModTime())
+	if err := index.UseState("state"); err != nil {
+		t.Fatal(err)
+	}
+	after, err := index.GetIndex("./")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after["file"].Checksum == before["file"].Checksum {
+		t.Error("Changed file wasn't rehashed")
+	}
+	index.UseState("")
+}
+
+func TestAlgorithms(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-algorithms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+	ioutil.WriteFile("file", []byte("abc"), 0644)
+
+	const sha256abc = "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+	if sum := index.GetChecksumWith("file", "sha256"); sum != sha256abc {
+		t.Errorf("sha256 checksum is %s, expected %s", sum, sha256abc)
+	}
+	files, err := index.GetIndexWith("./", "crc64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files["file"].Algorithm != "crc64" || files["file"].Checksum != index.GetChecksumWith("file", "crc64") {
+		t.Error("Index doesn't use the requested algorithm")
+	}
+	if files["file"].Checksum == index.GetChecksum("file") {
+		t.Error("crc64 and the default algorithm gave the same checksum")
+	}
+	if index.SupportedAlgorithm("md5") == true {
+		t.Error("md5 shouldn't be supported")
+	}
+}
@@ -0,0 +1,22 @@
+// +build windows plan9
+
+package index
+
+import (
+	"os"
+)
+
+//File ownership isn't available on this platform
+func fileOwner(info os.FileInfo) (int, int) {
+	return 0, 0
+}
+
+//Hard links aren't detected on this platform
+func FileLinkGroup(info os.FileInfo) string {
+	return ""
+}
+
+//Inodes and change times aren't available on this platform
+func fileIdentity(info os.FileInfo) (uint64, int64) {
+	return 0, 0
+}
@@ -0,0 +1,38 @@
+// +build !windows,!plan9
+
+package index
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+//fileOwner returns the numeric user and group id of the file described by info
+func fileOwner(info os.FileInfo) (int, int) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if ok == false {
+		return 0, 0
+	}
+	return int(stat.Uid), int(stat.Gid)
+}
+
+//FileLinkGroup identifies the content of a file with more than one hard link by its device
+//and inode, so all the links to it share the same group. Empty if the file has one link
+func FileLinkGroup(info os.FileInfo) string {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if ok == false || stat.Nlink < 2 {
+		return ""
+	}
+	return fmt.Sprintf("%x:%x", uint64(stat.Dev), uint64(stat.Ino))
+}
+
+//fileIdentity returns the inode number and change time of the file described by info, which
+//change whenever the file is replaced, or its content or metadata is modified
+func fileIdentity(info os.FileInfo) (uint64, int64) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if ok == false {
+		return 0, 0
+	}
+	return uint64(stat.Ino), statChangeTime(stat)
+}
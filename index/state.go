@@ -0,0 +1,137 @@
+package index
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/tywkeene/autobd/utils"
+)
+
+//fileState is the stat data a file had when it was last hashed. As long as it doesn't
+//change, neither has the file, so its checksums can be reused
+type fileState struct {
+	Size      int64             `json:"size"`
+	ModTime   int64             `json:"mtime"`
+	Inode     uint64            `json:"inode"`
+	Ctime     int64             `json:"ctime"`
+	Checksums map[string]string `json:"checksums"` //Indexed by algorithm
+}
+
+//The checksums of the regular files indexed so far, by path
+var state = make(map[string]*fileState)
+
+//Where state is saved, empty if it's only kept in memory
+var stateFile string
+
+//Set when state has changed since it was last saved
+var stateChanged bool
+
+//For synchronized access to state
+var stateLock = sync.Mutex{}
+
+func newFileState(info os.FileInfo) *fileState {
+	inode, ctime := fileIdentity(info)
+	return &fileState{
+		Size:      info.Size(),
+		ModTime:   info.ModTime().UnixNano(),
+		Inode:     inode,
+		Ctime:     ctime,
+		Checksums: make(map[string]string),
+	}
+}
+
+//UseState loads the checksums saved in filename, and saves them there from now on,
+//so files that haven't changed aren't rehashed after a restart
+func UseState(filename string) error {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	stateFile = filename
+	serial, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) == true {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var loaded map[string]*fileState
+	if err := json.Unmarshal(serial, &loaded); err != nil {
+		return err
+	}
+	if loaded != nil {
+		state = loaded
+	}
+	return nil
+}
+
+//stateNames collects the names of the regular files in files
+func stateNames(files map[string]*Index, names map[string]bool) map[string]bool {
+	for name, file := range files {
+		if file.IsDir == true {
+			stateNames(file.Files, names)
+		} else if file.Checksum != "" {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+//SaveState writes the checksums of the files in files to the state file set by UseState(),
+//forgetting the files that are no longer in files. Does nothing if nothing changed
+func SaveState(files map[string]*Index) error {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	if stateFile == "" {
+		return nil
+	}
+	names := stateNames(files, make(map[string]bool))
+	for name := range state {
+		if names[name] == false {
+			delete(state, name)
+			stateChanged = true
+		}
+	}
+	if stateChanged == false {
+		return nil
+	}
+	serial, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := utils.WriteFile(stateFile, bytes.NewReader(serial), nil); err != nil {
+		return err
+	}
+	stateChanged = false
+	return nil
+}
+
+//checksum returns the checksum of the regular file name, described by info, computed with
+//algorithm. The file is only hashed if its stat data changed since it was last hashed
+func checksum(name string, info os.FileInfo, algorithm string) string {
+	current := newFileState(info)
+	stateLock.Lock()
+	known, ok := state[name]
+	if ok == true && known.Size == current.Size && known.ModTime == current.ModTime &&
+		known.Inode == current.Inode && known.Ctime == current.Ctime {
+		if sum, ok := known.Checksums[algorithm]; ok == true {
+			stateLock.Unlock()
+			return sum
+		}
+		//Only the checksum with this algorithm is missing, keep the others
+		if known.Checksums != nil {
+			current.Checksums = known.Checksums
+		}
+	}
+	stateLock.Unlock()
+	sum := hashFile(name, algorithm, getHashLimiter())
+	if sum == "" {
+		return ""
+	}
+	stateLock.Lock()
+	current.Checksums[algorithm] = sum
+	state[name] = current
+	stateChanged = true
+	stateLock.Unlock()
+	return sum
+}
@@ -2,25 +2,39 @@
 package node
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/satori/go.uuid"
+	"github.com/tywkeene/autobd/certs"
 	"github.com/tywkeene/autobd/connection"
+	"github.com/tywkeene/autobd/delta"
 	"github.com/tywkeene/autobd/index"
 	"github.com/tywkeene/autobd/options"
+	"github.com/tywkeene/autobd/throttle"
 	"github.com/tywkeene/autobd/utils"
 	"github.com/tywkeene/autobd/version"
 	"io/ioutil"
 	"os"
+	"path"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
 type Node struct {
-	Servers map[string]*connection.Connection
-	UUID    string
-	Config  options.NodeConf
+	Servers   map[string]*connection.Connection
+	UUID      string
+	Config    options.NodeConf
+	transfers chan struct{}                      //Limits how many transfers run at the same time across all servers, nil for no limit
+	pins      map[string]*certs.Pin              //Server certificates pinned the first time the node connected, by server address
+	pinsLock  sync.Mutex                         //For synchronized writes of the pins file
+	indexes   map[string]map[string]*index.Index //The last index received from each server, by server address
+	indexLock sync.Mutex                         //For synchronized access to indexes
+	claimed   map[string]bool                    //Names of the files being transferred, from any server
+	claimLock sync.Mutex                         //For synchronized access to claimed
 }
 
 var localNode *Node
@@ -28,10 +42,21 @@ var localNode *Node
 func newNode(config options.NodeConf) *Node {
 	userAgent := "Autobd-node/" + version.GetVersion()
 	servers := make(map[string]*connection.Connection, 0)
+	node := &Node{Servers: servers, UUID: "", Config: config, pins: make(map[string]*certs.Pin),
+		indexes: make(map[string]map[string]*index.Index), claimed: make(map[string]bool)}
+	pinned, err := node.readPins()
+	utils.HandlePanic(err)
 	for _, url := range config.Servers {
-		servers[url] = connection.NewConnection(url, userAgent)
+		pin, err := node.serverPin(url, pinned)
+		utils.HandlePanic(err)
+		tlsConfig, err := certs.ClientConfig(config.ServerCA, config.ClientCert, config.ClientKey, pin)
+		utils.HandlePanic(err)
+		servers[url] = connection.NewConnection(url, userAgent, tlsConfig)
+	}
+	if config.MaxTransfers > 0 {
+		node.transfers = make(chan struct{}, config.MaxTransfers)
 	}
-	return &Node{Servers: servers, UUID: "", Config: config}
+	return node
 }
 
 func InitNode(config options.NodeConf) *Node {
@@ -46,6 +71,20 @@ func InitNode(config options.NodeConf) *Node {
 		node.ReadNodeUUID()
 		log.Infof("Read node UUID (%s) from (%s) ", node.UUID, node.Config.UUIDPath)
 	}
+	err := node.ReadNodeSecrets()
+	utils.HandleError(err, utils.ErrorActionErr)
+	for _, algorithm := range options.Config.HashAlgorithms {
+		if index.SupportedAlgorithm(algorithm) == false {
+			log.Panicf("Unsupported hash algorithm '%s', must be one of %v", algorithm, index.Algorithms())
+		}
+	}
+	schedule, err := throttle.ParseSchedule(options.Config.BandwidthLimit)
+	utils.HandleError(err, utils.ErrorActionErr)
+	connection.LimitDownloads(throttle.NewScheduledLimiter(schedule))
+	if options.Config.IndexStateFile != "" {
+		err := index.UseState(options.Config.IndexStateFile)
+		utils.HandleError(err, utils.ErrorActionWarn)
+	}
 	return node
 }
 
@@ -74,6 +113,44 @@ func (node *Node) ReadNodeUUID() error {
 	return json.Unmarshal(serial, &node.UUID)
 }
 
+//ReadNodeSecrets reads the secrets the servers gave the node when it enrolled from
+//node.Config.SecretPath, so the node's requests to them are signed
+func (node *Node) ReadNodeSecrets() error {
+	serial, err := ioutil.ReadFile(node.Config.SecretPath)
+	if os.IsNotExist(err) == true {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var secrets map[string]string
+	if err := json.Unmarshal(serial, &secrets); err != nil {
+		return err
+	}
+	for address, secret := range secrets {
+		if server, ok := node.Servers[address]; ok == true {
+			server.NodeUUID = node.UUID
+			server.Secret = secret
+		}
+	}
+	return nil
+}
+
+//WriteNodeSecrets writes the secrets the servers gave the node to node.Config.SecretPath, indexed by
+//server address. Only the owner can read the file
+func (node *Node) WriteNodeSecrets() error {
+	secrets := make(map[string]string)
+	for address, server := range node.Servers {
+		if server.Secret != "" {
+			secrets[address] = server.Secret
+		}
+	}
+	serial, err := json.MarshalIndent(&secrets, " ", " ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFile(node.Config.SecretPath, bytes.NewReader(serial), nil)
+}
+
 func (node *Node) validateServerVersion(remote *version.VersionInfo) error {
 	remoteMajor := strings.Split(remote.Version, ".")[0]
 	if version.GetMajor() != remoteMajor {
@@ -134,15 +211,35 @@ func (node *Node) Identify() error {
 				return err
 			}
 		}
-		_, err = server.IdentifyWithServer(version.GetVersion(), node.UUID, options.Config.NodeConfig.TargetDirectory)
+		secret := server.Secret
+		//Once the node enrolled it has a secret, and doesn't need to send the join token again
+		joinToken := ""
+		if secret == "" {
+			joinToken = node.Config.JoinToken
+		}
+		err = server.IdentifyWithServer(version.GetVersion(), node.UUID, options.Config.NodeConfig.TargetDirectory,
+			options.Config.HashAlgorithms, joinToken)
 		if utils.HandleError(err, utils.ErrorActionErr) == true {
 			continue
 		}
+		//The server enrolled the node
+		if server.Secret != secret {
+			log.Infof("Server (%s) gave the node a secret, writing it to (%s)", server.Address, node.Config.SecretPath)
+			err = node.WriteNodeSecrets()
+			utils.HandleError(err, utils.ErrorActionErr)
+		}
 	}
 	node.StartHeart()
 	return nil
 }
 
+//sameTree reports whether local and remote are directories with identical contents, going by
+//their checksums
+func sameTree(local *index.Index, remote *index.Index) bool {
+	return local.IsDir == true && remote.IsDir == true && remote.Checksum != "" &&
+		local.Checksum == remote.Checksum
+}
+
 func CompareDirs(local map[string]*index.Index, remote map[string]*index.Index) []*index.Index {
 	need := make([]*index.Index, 0)
 	for objName, remoteObject := range remote {
@@ -152,6 +249,10 @@ func CompareDirs(local map[string]*index.Index, remote map[string]*index.Index)
 			need = append(need, remoteObject)
 			continue
 		}
+		//If it's a directory with the same checksum on both sides, nothing below it changed
+		if sameTree(local[objName], remoteObject) == true {
+			continue
+		}
 		// If it does, and it's a directory, and it has children
 		if existsLocally == true && remoteObject.IsDir == true && remoteObject.Files != nil {
 			dirNeed := CompareDirs(local[objName].Files, remoteObject.Files) //Scan the children
@@ -165,32 +266,331 @@ func CompareDirs(local map[string]*index.Index, remote map[string]*index.Index)
 				need = append(need, remoteObject)
 				continue
 			}
+			//Symbolic links have no checksum, compare their targets
+			if local[objName].Link != remoteObject.Link {
+				log.Info("Link mismatch:", objName)
+				need = append(need, remoteObject)
+				continue
+			}
 		}
 	}
 	return need
 }
 
-//Compare a local and remote index, return a slice of needed indexes (or nil)
-func (node *Node) CompareIndex(target string, server *connection.Connection) ([]*index.Index, error) {
-	serial, err := server.RequestIndex(target, node.UUID)
-	if utils.HandleError(err, utils.ErrorActionErr) == true {
+//metadataDiffers reports whether the mode, modification time, or ownership of the node's copy of
+//a file differs from the server's. Ownership is only compared if the node is able to change it
+func metadataDiffers(local *index.Index, remote *index.Index) bool {
+	if local.Mode != remote.Mode || local.ModTime.Equal(remote.ModTime) == false {
+		return true
+	}
+	if utils.CanChown() == true {
+		uid, gid := utils.MapOwner(remote.UID, remote.GID)
+		return local.UID != uid || local.GID != gid
+	}
+	return false
+}
+
+//CompareMetadata returns the remote objects whose content the node already has, but whose
+//mode, modification time or ownership differ from the node's copy, children before their parents
+func CompareMetadata(local map[string]*index.Index, remote map[string]*index.Index) []*index.Index {
+	differs := make([]*index.Index, 0)
+	for objName, remoteObject := range remote {
+		localObject, existsLocally := local[objName]
+		if existsLocally == false || localObject.IsDir != remoteObject.IsDir {
+			continue
+		}
+		//The metadata of symbolic links isn't synced, only their target
+		if localObject.Link != "" || remoteObject.Link != "" {
+			continue
+		}
+		if remoteObject.IsDir == true {
+			if sameTree(localObject, remoteObject) == false {
+				differs = append(differs, CompareMetadata(localObject.Files, remoteObject.Files)...)
+			}
+		} else if localObject.Checksum != remoteObject.Checksum {
+			//The file will be synced, which takes care of its metadata
+			continue
+		}
+		if metadataDiffers(localObject, remoteObject) == true {
+			differs = append(differs, remoteObject)
+		}
+	}
+	return differs
+}
+
+//CompareDeleted returns the objects in local that no longer exist in remote.
+//A directory missing from remote is returned once, without its children
+func CompareDeleted(local map[string]*index.Index, remote map[string]*index.Index) []*index.Index {
+	deleted := make([]*index.Index, 0)
+	for objName, localObject := range local {
+		remoteObject, existsRemotely := remote[objName]
+		if existsRemotely == false {
+			deleted = append(deleted, localObject)
+			continue
+		}
+		//Both sides have the directory, so look for deleted children
+		if localObject.IsDir == true && remoteObject.IsDir == true && localObject.Files != nil &&
+			sameTree(localObject, remoteObject) == false {
+			deleted = append(deleted, CompareDeleted(localObject.Files, remoteObject.Files)...)
+		}
+	}
+	return deleted
+}
+
+//existsIn reports whether name is in tree. Directories whose contents were left out of tree, because they
+//were the same as the node's copy, are assumed to hold everything the node has below them
+func existsIn(tree map[string]*index.Index, name string) bool {
+	for objName, object := range tree {
+		if objName == name {
+			return true
+		}
+		if object.IsDir == true && strings.HasPrefix(name, objName+"/") == true {
+			return object.Files == nil || existsIn(object.Files, name)
+		}
+	}
+	return false
+}
+
+//CompareDeletedAll returns the objects in local that don't exist in any of remotes, the indexes of
+//every server the node syncs the tree from. Nothing is deleted until every server's index is known,
+//so a nil index in remotes returns nothing
+func CompareDeletedAll(local map[string]*index.Index, remotes []map[string]*index.Index) []*index.Index {
+	deleted := make([]*index.Index, 0)
+	if len(remotes) == 0 {
+		return deleted
+	}
+	for _, remote := range remotes {
+		if remote == nil {
+			return deleted
+		}
+	}
+	for _, object := range CompareDeleted(local, remotes[0]) {
+		kept := false
+		for _, remote := range remotes[1:] {
+			if existsIn(remote, object.Name) == true {
+				kept = true
+				break
+			}
+		}
+		if kept == false {
+			deleted = append(deleted, object)
+		}
+	}
+	return deleted
+}
+
+//remoteIndexes records remoteIndex as the index of server, and returns it along with the last index
+//received from every other server, nil for those the node didn't get one from yet
+func (node *Node) remoteIndexes(server *connection.Connection,
+	remoteIndex map[string]*index.Index) []map[string]*index.Index {
+	node.indexLock.Lock()
+	defer node.indexLock.Unlock()
+	node.indexes[server.Address] = remoteIndex
+	remotes := []map[string]*index.Index{remoteIndex}
+	for address := range node.Servers {
+		if address != server.Address {
+			remotes = append(remotes, node.indexes[address])
+		}
+	}
+	return remotes
+}
+
+//flatten returns every file in tree, indexed by name
+func flatten(tree map[string]*index.Index, files map[string]*index.Index) map[string]*index.Index {
+	for name, object := range tree {
+		files[name] = object
+		if object.IsDir == true {
+			flatten(object.Files, files)
+		}
+	}
+	return files
+}
+
+//CompareLinks finds the hard link groups in remote that the node already has the content
+//of. It returns, for each of those groups, the name of a local file the rest of the group
+//can be linked to, and the files that have the right content but are separate copies
+//on the node, which need to be relinked
+func CompareLinks(local map[string]*index.Index, remote map[string]*index.Index) (map[string]string, []*index.Index) {
+	groups := make(map[string][]*index.Index)
+	for _, object := range flatten(remote, make(map[string]*index.Index)) {
+		if object.LinkGroup != "" {
+			groups[object.LinkGroup] = append(groups[object.LinkGroup], object)
+		}
+	}
+	localFiles := flatten(local, make(map[string]*index.Index))
+	upToDate := func(object *index.Index) *index.Index {
+		localObject, exists := localFiles[object.Name]
+		if exists == false || localObject.Link != "" || localObject.Checksum != object.Checksum {
+			return nil
+		}
+		return localObject
+	}
+
+	sources := make(map[string]string)
+	relink := make([]*index.Index, 0)
+	for group, members := range groups {
+		sort.Slice(members, func(i, j int) bool { return members[i].Name < members[j].Name })
+		var source *index.Index
+		for _, member := range members {
+			if source = upToDate(member); source != nil {
+				break
+			}
+		}
+		if source == nil {
+			continue
+		}
+		sources[group] = source.Name
+		for _, member := range members {
+			localObject := upToDate(member)
+			if localObject == nil || localObject == source {
+				continue
+			}
+			if localObject.LinkGroup == "" || localObject.LinkGroup != source.LinkGroup {
+				relink = append(relink, member)
+			}
+		}
+	}
+	return sources, relink
+}
+
+//Changes is everything the node needs to do to bring its copy of the tree up to date with a server
+type Changes struct {
+	Need     []*index.Index    //Objects the node is missing, or has a different version of
+	Metadata []*index.Index    //Objects whose content is up to date, but whose metadata isn't
+	Deleted  []*index.Index    //Objects that were deleted on every server, only set in mirror mode
+	Relink   []*index.Index    //Files the node has as separate copies, that are hard links on the server
+	Sources  map[string]string //Local files that hard link groups can be linked to, by group
+}
+
+//requestIndex requests the server's index of dirPath, depth levels deep, or all of it if depth is 0
+func (node *Node) requestIndex(server *connection.Connection, dirPath string, depth int) (map[string]*index.Index, error) {
+	serial, err := server.RequestIndex(dirPath, node.UUID, depth)
+	if err != nil {
 		return nil, err
 	}
 	var remoteIndex map[string]*index.Index
 	if err := json.Unmarshal(serial, &remoteIndex); err != nil {
-		if utils.HandleError(err, utils.ErrorActionErr) == true {
+		return nil, err
+	}
+	return remoteIndex, nil
+}
+
+//requestChanges requests the changes on the server since the node was last synced with it. If wait is set,
+//the server holds on to the request until something changes, or until it times out
+func (node *Node) requestChanges(server *connection.Connection, dirPath string, wait bool) (*index.ChangeSet, error) {
+	request := server.RequestChanges
+	if wait == true {
+		request = server.WaitForChanges
+	}
+	serial, err := request(dirPath, node.UUID, server.Journal, server.Sequence)
+	if err != nil {
+		return nil, err
+	}
+	var changeSet *index.ChangeSet
+	if err := json.Unmarshal(serial, &changeSet); err != nil {
+		return nil, err
+	}
+	return changeSet, nil
+}
+
+//fetchIndex requests the server's index of dirPath one level at a time, only descending into the
+//directories whose checksum differs from the node's copy in local. Directories that are the same
+//on both sides are left without their contents, which the Compare functions skip
+func (node *Node) fetchIndex(server *connection.Connection, dirPath string,
+	local map[string]*index.Index) (map[string]*index.Index, error) {
+	remote, err := node.requestIndex(server, dirPath, 1)
+	if err != nil {
+		return nil, err
+	}
+	for name, remoteObject := range remote {
+		//Servers that don't support depth send the whole tree
+		if remoteObject.IsDir == false || remoteObject.Files != nil {
+			continue
+		}
+		localObject, existsLocally := local[name]
+		if existsLocally == true && sameTree(localObject, remoteObject) == true {
+			continue
+		}
+		if existsLocally == false || localObject.IsDir == false {
+			//The node has none of it, so the whole tree is needed to verify the transfer
+			remoteObject.Files, err = node.requestIndex(server, name, 0)
+		} else {
+			remoteObject.Files, err = node.fetchIndex(server, name, localObject.Files)
+		}
+		if err != nil {
 			return nil, err
 		}
 	}
+	return remote, nil
+}
+
+//Compare a local and remote index, and return the changes needed to bring the local one up to date.
+//If remoteIndex is nil, the parts of the server's index that differ from the local one are requested
+func (node *Node) CompareIndex(target string, server *connection.Connection,
+	remoteIndex map[string]*index.Index) (*Changes, error) {
 	if _, err := os.Stat(target); os.IsNotExist(err) {
 		os.Mkdir(target, 0755)
 	}
-	localIndex, err := index.GetIndex(target)
+	//Checksums are only comparable if they were computed with the algorithm the server chose
+	localIndex, err := index.GetIndexWith(target, server.Algorithm)
 	if err != nil {
 		return nil, err
 	}
-	need := CompareDirs(localIndex, remoteIndex)
-	return need, nil
+	err = index.SaveState(localIndex)
+	utils.HandleError(err, utils.ErrorActionWarn)
+	if remoteIndex == nil {
+		remoteIndex, err = node.fetchIndex(server, target, localIndex)
+		if utils.HandleError(err, utils.ErrorActionErr) == true {
+			return nil, err
+		}
+	}
+	changes := &Changes{
+		Need:     CompareDirs(localIndex, remoteIndex),
+		Metadata: CompareMetadata(localIndex, remoteIndex),
+	}
+	changes.Sources, changes.Relink = CompareLinks(localIndex, remoteIndex)
+	//A file only one of the servers has is still wanted, so only remove what none of them have
+	if node.Config.Mirror == true {
+		changes.Deleted = CompareDeletedAll(localIndex, node.remoteIndexes(server, remoteIndex))
+	}
+	return changes, nil
+}
+
+//isProtected reports whether name is one of the node's own files, which must never be
+//removed in mirror mode even though they don't exist on the server
+func (node *Node) isProtected(name string) bool {
+	name = path.Clean(name)
+	if name == path.Clean(node.Config.UUIDPath) || utils.IsTempFile(name) == true ||
+		(node.Config.SecretPath != "" && name == path.Clean(node.Config.SecretPath)) ||
+		(node.Config.PinsPath != "" && name == path.Clean(node.Config.PinsPath)) {
+		return true
+	}
+	if node.Config.TrashDirectory != "" {
+		trash := path.Clean(node.Config.TrashDirectory)
+		if name == trash || strings.HasPrefix(name, trash+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+//Remove removes a file or directory tree that was deleted on the server. If the node has
+//a trash directory configured, the object is moved there instead, under a timestamped
+//directory so repeated removals of the same path don't collide
+func (node *Node) Remove(object *index.Index) error {
+	if node.isProtected(object.Name) == true {
+		return nil
+	}
+	if node.Config.TrashDirectory == "" {
+		log.Printf("Removing:%s", object.Name)
+		return os.RemoveAll(object.Name)
+	}
+	trashPath := path.Join(node.Config.TrashDirectory, time.Now().Format("20060102-150405"), object.Name)
+	if err := os.MkdirAll(path.Dir(trashPath), 0755); err != nil {
+		return err
+	}
+	log.Printf("Moving to trash:%s -> %s", object.Name, trashPath)
+	return os.Rename(object.Name, trashPath)
 }
 
 func (node *Node) IsSynced() bool {
@@ -202,58 +602,212 @@ func (node *Node) IsSynced() bool {
 	return true
 }
 
+//syncFile fetches a single file from server. When delta transfers are enabled and the node
+//already has a copy of the file worth updating, only the blocks that changed are transferred
+func (node *Node) syncFile(server *connection.Connection, object *index.Index) error {
+	if node.Config.DeltaTransfers == true {
+		info, err := os.Stat(object.Name)
+		if err == nil && info.Mode().IsRegular() == true && info.Size() >= delta.MinBlockSize {
+			err := server.RequestDeltaFile(object, node.UUID)
+			if err == nil {
+				return nil
+			}
+			log.Warnf("Delta transfer of %s failed, fetching the whole file: %s", object.Name, err.Error())
+		}
+	}
+	return server.RequestSyncFile(object, node.UUID)
+}
+
+//syncObject fetches a file or directory tree from server. Failed transfers, and transfers that
+//don't match the server's checksums, are retried up to node.Config.SyncRetries times
+func (node *Node) syncObject(server *connection.Connection, object *index.Index) error {
+	var err error
+	attempts := node.Config.SyncRetries + 1
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if object.IsDir == true {
+			err = server.RequestSyncDir(object, node.UUID)
+		} else {
+			err = node.syncFile(server, object)
+		}
+		if err == nil {
+			return nil
+		}
+		if _, stale := err.(*connection.StaleError); stale == true {
+			return err
+		}
+		if _, mismatch := err.(*connection.ChecksumError); mismatch == true {
+			log.Errorf("%s -> Attempt %d/%d: %s", server.Address, attempt, attempts, err.Error())
+		} else {
+			log.Warnf("%s -> Attempt %d/%d to sync %s failed: %s", server.Address, attempt, attempts,
+				object.Name, err.Error())
+		}
+	}
+	return fmt.Errorf("Giving up on %s after %d attempts: %s", object.Name, attempts, err.Error())
+}
+
+//createSymlink creates the symbolic link described by object, unless the symlink policy
+//says to skip links that point outside of the tree
+func createSymlink(object *index.Index) error {
+	if options.Config.SymlinkPolicy == options.SymlinkPolicySkip && utils.LinkEscapes(object.Name, object.Link) == true {
+		log.Debugf("Skipping symbolic link %s -> %s, it points outside of the tree", object.Name, object.Link)
+		return nil
+	}
+	return utils.Symlink(object.Link, object.Name)
+}
+
+//syncNeeded brings a single needed object up to date. Symbolic links are created from the index,
+//and files that are hard links to content the node already has are linked instead of fetched
+func (node *Node) syncNeeded(server *connection.Connection, object *index.Index, sources map[string]string) error {
+	//Names come from the server, so make sure they can't be used to write outside of the target directory
+	if _, err := utils.ConfinePath(node.Config.TargetDirectory, object.Name); err != nil {
+		return err
+	}
+	if object.Link != "" {
+		return createSymlink(object)
+	}
+	if object.LinkGroup != "" {
+		if source, ok := sources[object.LinkGroup]; ok == true {
+			err := utils.Link(source, object.Name)
+			if err == nil {
+				return nil
+			}
+			log.Warnf("Linking %s to %s failed, fetching it instead: %s", object.Name, source, err.Error())
+		}
+	}
+	if err := node.syncObject(server, object); err != nil {
+		return err
+	}
+	if object.LinkGroup != "" {
+		sources[object.LinkGroup] = object.Name
+	}
+	return nil
+}
+
 func (node *Node) Sync(server *connection.Connection) error {
-	need, err := node.CompareIndex(node.Config.TargetDirectory, server)
+	//Servers that don't keep a journal get compared in full every time
+	changeSet, err := node.requestChanges(server, node.Config.TargetDirectory, false)
+	if err != nil {
+		log.Debugf("Couldn't get changes from %s, comparing the whole index: %s", server.Address, err.Error())
+		changeSet = nil
+	}
+	return node.syncChanges(server, changeSet)
+}
+
+//syncChanges brings the node up to date with server, given changeSet, the changes on the server since
+//the node was last synced with it. If changeSet is nil, the whole tree is compared
+func (node *Node) syncChanges(server *connection.Connection, changeSet *index.ChangeSet) error {
+	//Nothing changed on the server, but files may have changed on the node, so the whole tree is
+	//still compared every node.Config.FullCompareEvery syncs
+	if changeSet != nil && server.Synced == true && changeSet.Journal == server.Journal &&
+		len(changeSet.Changes) == 0 && server.Skipped+1 < node.Config.FullCompareEvery {
+		server.Skipped++
+		return nil
+	}
+	server.Skipped = 0
+	var remoteIndex map[string]*index.Index
+	if changeSet != nil {
+		remoteIndex = changeSet.Index
+	}
+	changes, err := node.CompareIndex(node.Config.TargetDirectory, server, remoteIndex)
 	if err != nil {
 		return err
 	}
-	if len(need) > 0 {
+	for _, object := range changes.Deleted {
+		err := node.Remove(object)
+		utils.HandleError(err, utils.ErrorActionErr)
+	}
+	var failed error
+	if len(changes.Need) > 0 {
 		server.SetSynced(false)
-		for _, object := range need {
-			log.Printf("%s -> Need:%s", server.Address, object.Name)
-			if object.IsDir == true {
-				err := server.RequestSyncDir(object.Name, node.UUID)
-				if utils.HandleError(err, utils.ErrorActionInfo) == true {
-					continue
-				}
-			} else if object.IsDir == false {
-				err := server.RequestSyncFile(object.Name, node.UUID)
-				if err != nil {
-					//EOF just means the sync is finished, don't log an error
-					utils.HandleError(err, utils.ErrorActionInfo)
-					continue
-				}
-			}
-		}
-	} else {
+		failed = node.transfer(server, changes)
+	}
+	for _, object := range changes.Relink {
+		log.Printf("%s -> Relinking:%s", server.Address, object.Name)
+		err := utils.Link(changes.Sources[object.LinkGroup], object.Name)
+		utils.HandleError(err, utils.ErrorActionErr)
+	}
+	//Files that were synced above already have their metadata, these are the ones whose
+	//content was already up to date
+	for _, object := range changes.Metadata {
+		err := utils.SetMetadata(object.Name, object.Mode, object.ModTime, object.UID, object.GID)
+		utils.HandleError(err, utils.ErrorActionErr)
+	}
+	if len(changes.Need) == 0 {
 		server.SetSynced(true)
+		//Only move past these changes once nothing is left to transfer, so failed transfers are retried
+		if changeSet != nil {
+			server.Journal = changeSet.Journal
+			server.Sequence = changeSet.Sequence
+		}
+	}
+	return failed
+}
+
+//waitLoop syncs with server whenever it reports changes. Failed syncs, and servers that can't
+//report changes, are retried every updateInterval
+func (node *Node) waitLoop(server *connection.Connection, updateInterval time.Duration) {
+	for {
+		if server.Online == false {
+			time.Sleep(updateInterval)
+			continue
+		}
+		//The changes the server waited for are synced right away, without asking for them again
+		changeSet, err := node.requestChanges(server, node.Config.TargetDirectory, true)
+		if err != nil {
+			log.Debugf("Couldn't wait for changes on %s: %s", server.Address, err.Error())
+			time.Sleep(updateInterval)
+			err = node.Sync(server)
+		} else {
+			err = node.syncChanges(server, changeSet)
+		}
+		//After a successful sync the server is asked again right away, so changes made while the node
+		//was syncing are synced within seconds too
+		if utils.HandleError(err, utils.ErrorActionWarn) == true {
+			time.Sleep(updateInterval)
+		}
 	}
-	return nil
 }
 
 func (node *Node) UpdateLoop() error {
 	err := node.Identify()
 	utils.HandlePanic(err)
 
-	log.Printf("Running as a node. Updating every %s with %s",
-		node.Config.UpdateInterval, node.Config.Servers)
-
 	updateInterval, err := time.ParseDuration(node.Config.UpdateInterval)
 	utils.HandlePanic(err)
+	if node.Config.LongPoll == true {
+		log.Printf("Running as a node. Syncing with %s as soon as they change", node.Config.Servers)
+		for _, server := range node.Servers {
+			go node.waitLoop(server, updateInterval)
+		}
+		for {
+			time.Sleep(updateInterval)
+			if node.CountOnlineServers() == 0 {
+				utils.HandlePanic(fmt.Errorf("No servers online, dying"))
+			}
+		}
+	}
+
+	log.Printf("Running as a node. Updating every %s with %s",
+		node.Config.UpdateInterval, node.Config.Servers)
 	for {
 		time.Sleep(updateInterval)
 		if node.CountOnlineServers() == 0 {
 			utils.HandlePanic(fmt.Errorf("No servers online, dying"))
 		}
+		//Servers are synced at the same time, sharing the node's transfer slots
+		var synced sync.WaitGroup
 		for _, server := range node.Servers {
 			if server.Online == false {
 				log.Info("Skipping offline server: ", server.Address)
 				continue
 			}
-			err := node.Sync(server)
-			if utils.HandleError(err, utils.ErrorActionWarn) == true {
-				break
-			}
+			synced.Add(1)
+			go func(server *connection.Connection) {
+				defer synced.Done()
+				err := node.Sync(server)
+				utils.HandleError(err, utils.ErrorActionWarn)
+			}(server)
 		}
+		synced.Wait()
 	}
 }
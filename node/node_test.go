@@ -2,11 +2,13 @@ package node_test
 
 import (
 	"github.com/BurntSushi/toml"
+	"github.com/tywkeene/autobd/index"
 	"github.com/tywkeene/autobd/node"
 	"github.com/tywkeene/autobd/options"
 	"log"
 	"os"
 	"testing"
+	"time"
 )
 
 func getNodeConfig() options.NodeConf {
@@ -49,3 +51,115 @@ func ReadNodeUUID(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestCompareDeleted(t *testing.T) {
+	local := map[string]*index.Index{
+		"kept": &index.Index{Name: "kept"},
+		"gone": &index.Index{Name: "gone"},
+		"dir": &index.Index{Name: "dir", IsDir: true, Files: map[string]*index.Index{
+			"dir/kept": &index.Index{Name: "dir/kept"},
+			"dir/gone": &index.Index{Name: "dir/gone"},
+		}},
+		"gonedir": &index.Index{Name: "gonedir", IsDir: true, Files: map[string]*index.Index{
+			"gonedir/file": &index.Index{Name: "gonedir/file"},
+		}},
+	}
+	remote := map[string]*index.Index{
+		"kept": &index.Index{Name: "kept"},
+		"dir": &index.Index{Name: "dir", IsDir: true, Files: map[string]*index.Index{
+			"dir/kept": &index.Index{Name: "dir/kept"},
+		}},
+	}
+	deleted := node.CompareDeleted(local, remote)
+	if len(deleted) != 3 {
+		t.Fatalf("Expected 3 deleted objects, got %d", len(deleted))
+	}
+	for _, object := range deleted {
+		switch object.Name {
+		case "gone", "dir/gone", "gonedir":
+		default:
+			t.Errorf("Unexpected deleted object: %s", object.Name)
+		}
+	}
+}
+
+//Ensure a file is only deleted when none of the servers has it
+func TestCompareDeletedAll(t *testing.T) {
+	local := map[string]*index.Index{
+		"a":    &index.Index{Name: "a"},
+		"b":    &index.Index{Name: "b"},
+		"gone": &index.Index{Name: "gone"},
+		"dir": &index.Index{Name: "dir", IsDir: true, Files: map[string]*index.Index{
+			"dir/b": &index.Index{Name: "dir/b"},
+		}},
+		"same": &index.Index{Name: "same", IsDir: true, Checksum: "x", Files: map[string]*index.Index{
+			"same/file": &index.Index{Name: "same/file"},
+		}},
+	}
+	serverA := map[string]*index.Index{
+		"a": &index.Index{Name: "a"},
+	}
+	//The contents of "same" were left out, since they're the same as the node's
+	serverB := map[string]*index.Index{
+		"b":    &index.Index{Name: "b"},
+		"dir":  &index.Index{Name: "dir", IsDir: true, Files: map[string]*index.Index{"dir/b": &index.Index{Name: "dir/b"}}},
+		"same": &index.Index{Name: "same", IsDir: true, Checksum: "x"},
+	}
+	for _, remotes := range [][]map[string]*index.Index{{serverA, serverB}, {serverB, serverA}} {
+		deleted := node.CompareDeletedAll(local, remotes)
+		if len(deleted) != 1 || deleted[0].Name != "gone" {
+			t.Errorf("Expected only gone to be deleted, got %v", deleted)
+		}
+	}
+	if deleted := node.CompareDeletedAll(local, []map[string]*index.Index{serverA, nil}); len(deleted) != 0 {
+		t.Errorf("Deleted %d objects before every server's index was known", len(deleted))
+	}
+}
+
+func TestCompareMetadata(t *testing.T) {
+	now := time.Now()
+	local := map[string]*index.Index{
+		"same":    &index.Index{Name: "same", Checksum: "a", Mode: 0644, ModTime: now},
+		"mode":    &index.Index{Name: "mode", Checksum: "a", Mode: 0644, ModTime: now},
+		"modtime": &index.Index{Name: "modtime", Checksum: "a", Mode: 0644, ModTime: now},
+		"content": &index.Index{Name: "content", Checksum: "a", Mode: 0644, ModTime: now},
+	}
+	remote := map[string]*index.Index{
+		"same":    &index.Index{Name: "same", Checksum: "a", Mode: 0644, ModTime: now},
+		"mode":    &index.Index{Name: "mode", Checksum: "a", Mode: 0755, ModTime: now},
+		"modtime": &index.Index{Name: "modtime", Checksum: "a", Mode: 0644, ModTime: now.Add(time.Hour)},
+		"content": &index.Index{Name: "content", Checksum: "b", Mode: 0755, ModTime: now},
+		"missing": &index.Index{Name: "missing", Checksum: "a", Mode: 0644, ModTime: now},
+	}
+	differs := node.CompareMetadata(local, remote)
+	if len(differs) != 2 {
+		t.Fatalf("Expected 2 objects with different metadata, got %d", len(differs))
+	}
+	for _, object := range differs {
+		if object.Name != "mode" && object.Name != "modtime" {
+			t.Errorf("Unexpected object: %s", object.Name)
+		}
+	}
+}
+
+func TestCompareLinks(t *testing.T) {
+	local := map[string]*index.Index{
+		"a": &index.Index{Name: "a", Checksum: "x", LinkGroup: "1"},
+		"b": &index.Index{Name: "b", Checksum: "x"},
+		"c": &index.Index{Name: "c", Checksum: "x", LinkGroup: "1"},
+	}
+	remote := map[string]*index.Index{
+		"a": &index.Index{Name: "a", Checksum: "x", LinkGroup: "g"},
+		"b": &index.Index{Name: "b", Checksum: "x", LinkGroup: "g"},
+		"c": &index.Index{Name: "c", Checksum: "x", LinkGroup: "g"},
+		"d": &index.Index{Name: "d", Checksum: "x", LinkGroup: "g"},
+		"e": &index.Index{Name: "e", Checksum: "y", LinkGroup: "h"},
+	}
+	sources, relink := node.CompareLinks(local, remote)
+	if len(sources) != 1 || sources["g"] != "a" {
+		t.Fatalf("Expected group g to be linked to a, got %v", sources)
+	}
+	if len(relink) != 1 || relink[0].Name != "b" {
+		t.Fatalf("Expected only b to be relinked, got %v", relink)
+	}
+}
@@ -0,0 +1,75 @@
+package node
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/tywkeene/autobd/certs"
+	"github.com/tywkeene/autobd/utils"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+//readPins reads the fingerprints of the servers pinned the first time the node connected to them
+//from node.Config.PinsPath, indexed by server address
+func (node *Node) readPins() (map[string]string, error) {
+	pinned := make(map[string]string)
+	serial, err := ioutil.ReadFile(node.Config.PinsPath)
+	if os.IsNotExist(err) == true {
+		return pinned, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(serial, &pinned); err != nil {
+		return nil, err
+	}
+	return pinned, nil
+}
+
+//WritePins writes the fingerprints pinned so far to node.Config.PinsPath, indexed by server address
+func (node *Node) WritePins() error {
+	node.pinsLock.Lock()
+	defer node.pinsLock.Unlock()
+	pinned := make(map[string]string)
+	for address, pin := range node.pins {
+		if fingerprint := pin.Fingerprint(); fingerprint != "" {
+			pinned[address] = fingerprint
+		}
+	}
+	serial, err := json.MarshalIndent(&pinned, " ", " ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFile(node.Config.PinsPath, bytes.NewReader(serial), nil)
+}
+
+//serverPin returns the pin the certificate of the server at address has to match: the fingerprint
+//configured for it, or the one pinned the first time the node connected to it. If neither is known yet
+//the server's certificate is trusted on first use, if that's allowed. Returns nil if the server is
+//verified against tls_server_ca instead, or isn't using TLS
+func (node *Node) serverPin(address string, pinned map[string]string) (*certs.Pin, error) {
+	if fingerprint := node.Config.ServerFingerprints[address]; fingerprint != "" {
+		return certs.NewPin(fingerprint, nil), nil
+	}
+	if node.Config.ServerCA != "" || strings.HasPrefix(address, "https://") == false {
+		return nil, nil
+	}
+	if fingerprint := pinned[address]; fingerprint != "" {
+		pin := certs.NewPin(fingerprint, nil)
+		node.pins[address] = pin
+		return pin, nil
+	}
+	if node.Config.TrustOnFirstUse == false {
+		return nil, fmt.Errorf("Server (%s) can't be verified, set tls_server_ca or its fingerprint in server_fingerprints",
+			address)
+	}
+	pin := certs.NewPin("", func(fingerprint string) {
+		log.Warnf("Trusting server (%s) with certificate fingerprint %s on first use, writing it to (%s)",
+			address, fingerprint, node.Config.PinsPath)
+		utils.HandleError(node.WritePins(), utils.ErrorActionErr)
+	})
+	node.pins[address] = pin
+	return pin, nil
+}
@@ -0,0 +1,212 @@
+package node
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/tywkeene/autobd/connection"
+	"github.com/tywkeene/autobd/index"
+	"github.com/tywkeene/autobd/utils"
+	"sort"
+	"sync"
+)
+
+//TransferError is returned by Sync when some of the needed files couldn't be transferred.
+//The other transfers still went ahead
+type TransferError struct {
+	Server string
+	Failed map[string]error //Indexed by file name
+}
+
+func (e *TransferError) Error() string {
+	names := make([]string, 0, len(e.Failed))
+	for name := range e.Failed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Sprintf("%d transfers from %s failed, first %s: %s", len(names), e.Server, names[0],
+		e.Failed[names[0]].Error())
+}
+
+//transferErrors collects the errors of transfers running at the same time
+type transferErrors struct {
+	failed map[string]error
+	lock   sync.Mutex
+}
+
+func (t *transferErrors) add(name string, err error) {
+	if utils.HandleError(err, utils.ErrorActionErr) == false {
+		return
+	}
+	t.lock.Lock()
+	t.failed[name] = err
+	t.lock.Unlock()
+}
+
+//batchable reports whether object is a small regular file that can be fetched in a batch. Hard linked
+//files are left out, they may be linked to a copy the node already has instead
+func (node *Node) batchable(object *index.Index) bool {
+	return node.Config.BatchFiles > 0 && object.IsDir == false && object.Link == "" &&
+		object.LinkGroup == "" && object.Size <= node.Config.BatchFileSize
+}
+
+//planTransfers splits need into batches of small files, objects that can be synced on their own at
+//the same time as everything else, and hard linked files, which are synced one at a time afterwards
+//so they can be linked to the ones synced before them
+func (node *Node) planTransfers(need []*index.Index) ([][]*index.Index, []*index.Index, []*index.Index) {
+	batches := make([][]*index.Index, 0)
+	single := make([]*index.Index, 0)
+	linked := make([]*index.Index, 0)
+	batch := make([]*index.Index, 0, node.Config.BatchFiles)
+	for _, object := range need {
+		//Names come from the server, so make sure they can't be used to write outside of the target
+		//directory. syncNeeded() refuses them with an error
+		_, err := utils.ConfinePath(node.Config.TargetDirectory, object.Name)
+		switch {
+		case object.LinkGroup != "":
+			linked = append(linked, object)
+		case err == nil && node.batchable(object) == true:
+			batch = append(batch, object)
+			if len(batch) == node.Config.BatchFiles {
+				batches = append(batches, batch)
+				batch = make([]*index.Index, 0, node.Config.BatchFiles)
+			}
+		default:
+			single = append(single, object)
+		}
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches, single, linked
+}
+
+//syncBatch fetches the files in batch with a single request, and then fetches the ones the batch
+//didn't deliver on their own
+func (node *Node) syncBatch(server *connection.Connection, batch []*index.Index, errors *transferErrors) {
+	log.Printf("%s -> Need:%d files in a batch", server.Address, len(batch))
+	written, err := server.RequestSyncBatch(batch, node.UUID, node.Config.TargetDirectory)
+	if err != nil {
+		log.Warnf("Batch transfer from %s failed, fetching the rest one at a time: %s", server.Address, err.Error())
+	}
+	for _, object := range batch {
+		if written[object.Name] == false {
+			log.Printf("%s -> Need:%s", server.Address, object.Name)
+			errors.add(object.Name, node.syncNeeded(server, object, nil))
+		}
+	}
+}
+
+//acquireTransfer waits for one of the node's transfer slots to be free
+func (node *Node) acquireTransfer() {
+	if node.transfers != nil {
+		node.transfers <- struct{}{}
+	}
+}
+
+func (node *Node) releaseTransfer() {
+	if node.transfers != nil {
+		<-node.transfers
+	}
+}
+
+//claim claims the names of objects for a transfer, so no other server transfers them at the same time.
+//Returns the objects that were claimed, and the ones another server is transferring already
+func (node *Node) claim(objects []*index.Index) ([]*index.Index, []*index.Index) {
+	node.claimLock.Lock()
+	defer node.claimLock.Unlock()
+	claimed := make([]*index.Index, 0, len(objects))
+	busy := make([]*index.Index, 0)
+	for _, object := range objects {
+		if node.claimed[object.Name] == true {
+			busy = append(busy, object)
+			continue
+		}
+		node.claimed[object.Name] = true
+		claimed = append(claimed, object)
+	}
+	return claimed, busy
+}
+
+func (node *Node) unclaim(objects []*index.Index) {
+	node.claimLock.Lock()
+	defer node.claimLock.Unlock()
+	for _, object := range objects {
+		delete(node.claimed, object.Name)
+	}
+}
+
+//transferJob is a batch of files, or a single object, for one of the workers to sync
+type transferJob struct {
+	objects []*index.Index
+	run     func(objects []*index.Index) //Syncs the objects of the job that were claimed
+}
+
+//transfer syncs the objects in changes.Need from server on node.Config.TransferWorkers workers, each
+//holding one of the node's transfer slots while it works. A failed transfer doesn't stop the others,
+//all of the failures are returned together as a *TransferError. If the server goes offline, the
+//transfers that didn't start yet are cancelled and fail. Files another server is transferring at the
+//same time fail too, and are retried on the next sync, so two servers never write the same file at once
+func (node *Node) transfer(server *connection.Connection, changes *Changes) error {
+	errors := &transferErrors{failed: make(map[string]error)}
+	batches, single, linked := node.planTransfers(changes.Need)
+	offline := fmt.Errorf("Server %s went offline", server.Address)
+	busy := fmt.Errorf("Being transferred from another server")
+	run := func(job *transferJob) {
+		node.acquireTransfer()
+		defer node.releaseTransfer()
+		if server.Online == false {
+			for _, object := range job.objects {
+				errors.add(object.Name, offline)
+			}
+			return
+		}
+		claimed, taken := node.claim(job.objects)
+		defer node.unclaim(claimed)
+		for _, object := range taken {
+			errors.add(object.Name, busy)
+		}
+		if len(claimed) > 0 {
+			job.run(claimed)
+		}
+	}
+
+	jobs := make(chan *transferJob)
+	var done sync.WaitGroup
+	workers := node.Config.TransferWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			for job := range jobs {
+				run(job)
+			}
+		}()
+	}
+	for _, batch := range batches {
+		jobs <- &transferJob{objects: batch, run: func(claimed []*index.Index) { node.syncBatch(server, claimed, errors) }}
+	}
+	for _, object := range single {
+		object := object
+		jobs <- &transferJob{objects: []*index.Index{object}, run: func([]*index.Index) {
+			log.Printf("%s -> Need:%s", server.Address, object.Name)
+			errors.add(object.Name, node.syncNeeded(server, object, nil))
+		}}
+	}
+	close(jobs)
+	done.Wait()
+
+	for _, object := range linked {
+		object := object
+		run(&transferJob{objects: []*index.Index{object}, run: func([]*index.Index) {
+			log.Printf("%s -> Need:%s", server.Address, object.Name)
+			errors.add(object.Name, node.syncNeeded(server, object, changes.Sources))
+		}})
+	}
+	if len(errors.failed) > 0 {
+		return &TransferError{Server: server.Address, Failed: errors.failed}
+	}
+	return nil
+}
@@ -0,0 +1,287 @@
+package node_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/tywkeene/autobd/index"
+	"github.com/tywkeene/autobd/node"
+	"github.com/tywkeene/autobd/options"
+	"github.com/tywkeene/autobd/version"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//fakeServer serves the index of files, and their contents by checksum, the way a server does to a node
+//that has to compare its whole tree. fail is called with the name of each file before it's served, and
+//the file is refused if it returns true. Nodes waiting for changes are told about them once sequence
+//passes the one they last saw
+type fakeServer struct {
+	*httptest.Server
+	files    map[string][]byte
+	index    map[string]*index.Index
+	sequence uint64
+	requests int
+	lock     sync.Mutex
+	fail     func(name string) bool
+}
+
+func newFakeServer(t *testing.T, files map[string][]byte) *fakeServer {
+	server := &fakeServer{files: make(map[string][]byte), index: make(map[string]*index.Index)}
+	for name, content := range files {
+		server.add(t, name, content)
+	}
+	server.Server = httptest.NewServer(http.HandlerFunc(server.serve))
+	return server
+}
+
+//add adds a file holding content to the server, as a change nodes waiting for changes are told about
+func (s *fakeServer) add(t *testing.T, name string, content []byte) {
+	source, err := ioutil.TempFile("", "autobd-source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	source.Write(content)
+	source.Close()
+	checksum := index.GetChecksum(source.Name())
+	os.Remove(source.Name())
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.files[checksum] = content
+	s.index[name] = &index.Index{Name: name, Checksum: checksum, Size: int64(len(content)),
+		ModTime: time.Now(), Mode: 0644, UID: os.Getuid(), GID: os.Getgid()}
+	s.sequence++
+}
+
+//wait answers a node waiting for changes once there are changes it didn't see yet, or after a short
+//while without any
+func (s *fakeServer) wait(w http.ResponseWriter, r *http.Request) {
+	since, _ := strconv.ParseUint(r.URL.Query().Get("since"), 10, 64)
+	changeSet := &index.ChangeSet{Journal: "fake", Sequence: since, Changes: []index.Change{}}
+	for deadline := time.Now().Add(100 * time.Millisecond); time.Now().Before(deadline); {
+		s.lock.Lock()
+		sequence := s.sequence
+		s.lock.Unlock()
+		if sequence > since {
+			changeSet.Sequence = sequence
+			changeSet.Changes = append(changeSet.Changes, index.Change{Sequence: sequence, Event: index.EventCreate})
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	serial, _ := json.Marshal(changeSet)
+	w.Write(serial)
+}
+
+func (s *fakeServer) serve(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/version"):
+		w.Write([]byte(`{"version": "` + version.GetVersion() + `"}`))
+	case strings.HasSuffix(r.URL.Path, "/identify"), strings.HasSuffix(r.URL.Path, "/heartbeat"):
+	case strings.HasSuffix(r.URL.Path, "/wait"):
+		s.wait(w, r)
+	case strings.HasSuffix(r.URL.Path, "/index"):
+		s.lock.Lock()
+		serial, _ := json.Marshal(s.index)
+		s.lock.Unlock()
+		w.Write(serial)
+	case strings.Contains(r.URL.Path, "/blob/"):
+		s.lock.Lock()
+		s.requests++
+		content := s.files[path.Base(r.URL.Path)]
+		s.lock.Unlock()
+		if s.fail != nil && s.fail(r.URL.Query().Get("grab")) == true {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"http_status": 500, "error": "failed"}`))
+			return
+		}
+		//Send the file in two halves, so transfers from other servers get a chance to overlap
+		w.Write(content[:len(content)/2])
+		w.(http.Flusher).Flush()
+		time.Sleep(10 * time.Millisecond)
+		w.Write(content[len(content)/2:])
+	default:
+		//Servers without a journal make the node compare the whole tree
+		http.NotFound(w, r)
+	}
+}
+
+//newTransferNode returns a node syncing "data" in a new temporary directory, which is made the
+//working directory until the returned function is called
+func newTransferNode(t *testing.T, workers int, servers ...*fakeServer) (*node.Node, func()) {
+	dir, err := ioutil.TempDir("", "autobd-transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, _ := os.Getwd()
+	os.Chdir(dir)
+	config := options.NodeConf{
+		TargetDirectory: "data",
+		UUIDPath:        path.Join(dir, "uuid"),
+		TransferWorkers: workers,
+		UpdateInterval:  "1m",
+	}
+	for _, server := range servers {
+		config.Servers = append(config.Servers, server.URL)
+	}
+	return node.InitNode(config), func() {
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	}
+}
+
+func syncedFiles(count int) map[string][]byte {
+	files := make(map[string][]byte)
+	for i := 0; i < count; i++ {
+		name := "data/file" + string('a'+rune(i))
+		files[name] = bytes.Repeat([]byte(name), 100)
+	}
+	return files
+}
+
+//Ensure a transfer that fails doesn't stop the others, and is reported
+func TestTransferError(t *testing.T) {
+	files := syncedFiles(5)
+	server := newFakeServer(t, files)
+	defer server.Close()
+	server.fail = func(name string) bool { return name == "data/fileb" }
+	localNode, cleanup := newTransferNode(t, 3, server)
+	defer cleanup()
+
+	err := localNode.Sync(localNode.Servers[server.URL])
+	transferErr, ok := err.(*node.TransferError)
+	if ok == false || len(transferErr.Failed) != 1 || transferErr.Failed["data/fileb"] == nil {
+		t.Fatalf("Expected only data/fileb to fail, got %v", err)
+	}
+	for name, content := range files {
+		synced, err := ioutil.ReadFile(name)
+		if name == "data/fileb" {
+			if err == nil {
+				t.Errorf("%s was synced, even though the server refused it", name)
+			}
+		} else if bytes.Equal(synced, content) == false {
+			t.Errorf("%s wasn't synced: %v", name, err)
+		}
+	}
+}
+
+//Ensure the transfers that didn't start yet are cancelled once the server goes offline
+func TestTransferCancel(t *testing.T) {
+	files := syncedFiles(5)
+	server := newFakeServer(t, files)
+	defer server.Close()
+	localNode, cleanup := newTransferNode(t, 1, server)
+	defer cleanup()
+	connection := localNode.Servers[server.URL]
+	server.fail = func(name string) bool {
+		connection.SetOnline(false)
+		return false
+	}
+
+	err := localNode.Sync(connection)
+	transferErr, ok := err.(*node.TransferError)
+	if ok == false || len(transferErr.Failed) != len(files)-1 {
+		t.Fatalf("Expected every transfer after the first to be cancelled, got %v", err)
+	}
+	if server.requests != 1 {
+		t.Errorf("Expected a single request, got %d", server.requests)
+	}
+}
+
+//Ensure two servers syncing the same file at the same time never write it at once. The file is transferred
+//from one of them, and the other fails it, and transfers it on its next sync
+func TestTransferSamePath(t *testing.T) {
+	first := newFakeServer(t, map[string][]byte{"data/file": bytes.Repeat([]byte("first"), 1000)})
+	defer first.Close()
+	second := newFakeServer(t, map[string][]byte{"data/file": bytes.Repeat([]byte("second"), 1000)})
+	defer second.Close()
+	localNode, cleanup := newTransferNode(t, 2, first, second)
+	defer cleanup()
+
+	//Hold the transfer from the first server until the second was synced
+	started := make(chan struct{})
+	release := make(chan struct{})
+	first.fail = func(name string) bool {
+		close(started)
+		<-release
+		return false
+	}
+	firstErr := make(chan error)
+	go func() { firstErr <- localNode.Sync(localNode.Servers[first.URL]) }()
+	<-started
+	err := localNode.Sync(localNode.Servers[second.URL])
+	close(release)
+	if err := <-firstErr; err != nil {
+		t.Fatalf("Sync with the first server failed: %s", err.Error())
+	}
+	if transferErr, ok := err.(*node.TransferError); ok == false || transferErr.Failed["data/file"] == nil {
+		t.Errorf("Expected the file being transferred from the first server to fail, got %v", err)
+	}
+	if second.requests != 0 {
+		t.Errorf("The file was transferred from both servers at once")
+	}
+	check := func(server *fakeServer) {
+		synced, err := ioutil.ReadFile("data/file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(synced, server.files[server.index["data/file"].Checksum]) == false {
+			t.Errorf("Expected the copy from %s", server.URL)
+		}
+		if leftover, _ := ioutil.ReadDir("data"); len(leftover) != 1 {
+			t.Errorf("Expected only the synced file in data, got %d files", len(leftover))
+		}
+	}
+	check(first)
+
+	first.fail = nil
+	if err := localNode.Sync(localNode.Servers[second.URL]); err != nil {
+		t.Fatalf("Sync with the second server failed: %s", err.Error())
+	}
+	check(second)
+}
+
+//waitFor waits up to timeout for the file name to hold content
+func waitFor(name string, content []byte, timeout time.Duration) bool {
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if synced, err := ioutil.ReadFile(name); err == nil && bytes.Equal(synced, content) == true {
+			return true
+		}
+	}
+	return false
+}
+
+//Ensure a node waiting for changes syncs a change made right after the last one it synced, without
+//waiting for the update interval first
+func TestWaitBackToBack(t *testing.T) {
+	server := newFakeServer(t, nil)
+	localNode, cleanup := newTransferNode(t, 1, server)
+	defer cleanup()
+	localNode.Config.LongPoll = true
+	localNode.Config.HeartbeatInterval = "1m"
+	go localNode.UpdateLoop()
+	//The loop never returns, so leave it idle once the server is offline, before the next test starts
+	defer func() {
+		localNode.Servers[server.URL].SetOnline(false)
+		server.Close()
+		time.Sleep(100 * time.Millisecond)
+	}()
+
+	first := bytes.Repeat([]byte("first"), 100)
+	server.add(t, "data/first", first)
+	if waitFor("data/first", first, 5*time.Second) == false {
+		t.Fatal("The first change wasn't synced")
+	}
+	second := bytes.Repeat([]byte("second"), 100)
+	server.add(t, "data/second", second)
+	if waitFor("data/second", second, 5*time.Second) == false {
+		t.Fatal("The second change wasn't synced before the update interval")
+	}
+}
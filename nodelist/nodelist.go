@@ -17,17 +17,43 @@ type NodeHeartbeat struct {
 }
 
 type NodeMetadata struct {
-	Version string `json:"version"`
-	UUID    string `json:"UUID"`
-	Target  string `json:"node_target_directory"`
+	Version    string   `json:"version"`
+	UUID       string   `json:"UUID"`
+	Target     string   `json:"node_target_directory"`
+	Algorithms []string `json:"hash_algorithms,omitempty"` //Hash algorithms the node supports, in order of preference
+	Algorithm  string   `json:"hash_algorithm,omitempty"`  //Hash algorithm chosen for the node's indexes
+	JoinToken  string   `json:"join_token,omitempty"`      //Token the node enrolls with, never stored
 }
 
+//IdentifyResponse is sent back to a node that identified, telling it which hash algorithm
+//the server chose for its indexes, out of the ones the server indexes with, and the secret to sign
+//its requests with when it enrolls
+type IdentifyResponse struct {
+	Algorithm  string   `json:"hash_algorithm"`
+	Algorithms []string `json:"hash_algorithms"`
+	Secret     string   `json:"secret,omitempty"` //Only sent when the node enrolls
+	Status     string   `json:"status,omitempty"` //Approval status of the node, if the server requires approval
+}
+
+//Approval status of a node. Nodes that enrolled before approval have none, and count as approved
+const (
+	StatusPending  = "pending"  //Waiting for an admin, the node can heartbeat but not fetch anything
+	StatusApproved = "approved" //The node is served as usual
+	StatusRejected = "rejected" //The node is refused everything
+)
+
 type Node struct {
-	Address    string        `json:"address"`     //Address of the node
-	LastOnline string        `json:"last_online"` //Timestamp of when the node last sent a heartbeat
-	IsOnline   bool          `json:"is_online"`   //Is the node currently online?
-	Synced     bool          `json:"synced"`      //Is the node synced with this server?
-	Meta       *NodeMetadata `json:"metadata"`    //Node Version, UUID and other misc. information about this node
+	Address    string        `json:"address"`              //Address of the node
+	LastOnline string        `json:"last_online"`          //Timestamp of when the node last sent a heartbeat
+	IsOnline   bool          `json:"is_online"`            //Is the node currently online?
+	Synced     bool          `json:"synced"`               //Is the node synced with this server?
+	Meta       *NodeMetadata `json:"metadata"`             //Node Version, UUID and other misc. information about this node
+	Secret     string        `json:"secret,omitempty"`     //Shared with the node when it enrolled, its requests are signed with it
+	Identity   string        `json:"identity,omitempty"`   //Common name of the certificate the node presents, when the server requires one
+	JoinToken  string        `json:"join_token,omitempty"` //ID of the join token the node enrolled with
+	Subtree    string        `json:"subtree,omitempty"`    //The node is only served this directory and below, as its join token allowed
+	Labels     []string      `json:"labels,omitempty"`     //Given to the node by its join token, informational only
+	Status     string        `json:"status,omitempty"`     //Approval status of the node, one of the Status constants
 }
 
 type NodeList map[string]*Node
@@ -42,6 +68,19 @@ func (node *Node) ShortUUID() string {
 	return node.Meta.UUID[:8]
 }
 
+//ApprovalStatus returns the approval status of the node, nodes without one are approved
+func (node *Node) ApprovalStatus() string {
+	if node.Status == "" {
+		return StatusApproved
+	}
+	return node.Status
+}
+
+//Approved reports whether the node can fetch data from the server
+func (node *Node) Approved() bool {
+	return node.ApprovalStatus() == StatusApproved
+}
+
 //Add a node to the CurrentNodes map synchronously
 func GetNodeByUUID(uuid string) *Node {
 	lock.RLock()
@@ -92,12 +131,16 @@ func ReadNodeList(path string) error {
 	return nil
 }
 
+//WriteNodeList writes CurrentNodes to path. Only the owner can read it, since it holds the nodes' secrets
 func WriteNodeList(path string) error {
-	outfile, err := os.Create(path)
+	outfile, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return err
 	}
 	defer outfile.Close()
+	if err := outfile.Chmod(0600); err != nil {
+		return err
+	}
 	serial, err := json.MarshalIndent(&CurrentNodes, " ", " ")
 	if err != nil {
 		return err
@@ -125,10 +168,48 @@ func UpdateNodeList() {
 	}
 }
 
+//SetNodeApproval sets the approval status of the node with uuid, and writes the node list to path
+//so the decision is kept. Returns false if there's no such node
+func SetNodeApproval(uuid string, status string, path string) (bool, error) {
+	node := GetNodeByUUID(uuid)
+	if node == nil {
+		return false, nil
+	}
+	node.Status = status
+	return true, WriteNodeList(path)
+}
+
+//ResetNodeSecret removes the secret of the node with uuid, so it can enroll again and be given a new one,
+//and writes the node list to path. Returns false if there's no such node
+func ResetNodeSecret(uuid string, path string) (bool, error) {
+	node := GetNodeByUUID(uuid)
+	if node == nil {
+		return false, nil
+	}
+	node.Secret = ""
+	return true, WriteNodeList(path)
+}
+
+//GetNodelistJson returns CurrentNodes encoded in json, without the nodes' secrets
 func GetNodelistJson() []byte {
+	return GetNodelistJsonByStatus("")
+}
+
+//GetNodelistJsonByStatus returns the nodes in CurrentNodes with the approval status, or all of them if
+//status is empty, encoded in json without the nodes' secrets
+func GetNodelistJsonByStatus(status string) []byte {
 	lock.RLock()
 	defer lock.RUnlock()
-	serial, err := json.MarshalIndent(&CurrentNodes, " ", " ")
+	public := make(NodeList, len(CurrentNodes))
+	for uuid, node := range CurrentNodes {
+		if status != "" && node.ApprovalStatus() != status {
+			continue
+		}
+		copied := *node
+		copied.Secret = ""
+		public[uuid] = &copied
+	}
+	serial, err := json.MarshalIndent(&public, " ", " ")
 	if utils.HandleError(err, utils.ErrorActionErr) == true {
 		return nil
 	}
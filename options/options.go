@@ -4,17 +4,41 @@ import (
 	"flag"
 	"fmt"
 	"github.com/BurntSushi/toml"
+	"github.com/tywkeene/autobd/throttle"
 	"os"
+	"strings"
+	"time"
 )
 
 type NodeConf struct {
-	Servers               []string `toml:"servers"`
-	UpdateInterval        string   `toml:"update_interval"`
-	HeartbeatInterval     string   `toml:"heartbeat_interval"`
-	MaxMissedBeats        int      `toml:"max_missed_beats"`
-	IgnoreVersionMismatch bool     `toml:"node_ignore_version_mismatch"`
-	TargetDirectory       string   `toml:"target_directory"`
-	UUIDPath              string   `toml:"uuid_path"`
+	Servers               []string          `toml:"servers"`
+	UpdateInterval        string            `toml:"update_interval"`
+	HeartbeatInterval     string            `toml:"heartbeat_interval"`
+	MaxMissedBeats        int               `toml:"max_missed_beats"`
+	IgnoreVersionMismatch bool              `toml:"node_ignore_version_mismatch"`
+	TargetDirectory       string            `toml:"target_directory"`
+	UUIDPath              string            `toml:"uuid_path"`
+	SecretPath            string            `toml:"secret_path"`
+	ServerCA              string            `toml:"tls_server_ca"`
+	ServerFingerprints    map[string]string `toml:"server_fingerprints"`
+	PinsPath              string            `toml:"pins_path"`
+	TrustOnFirstUse       bool              `toml:"trust_on_first_use"`
+	JoinToken             string            `toml:"join_token"`
+	ClientCert            string            `toml:"tls_client_cert"`
+	ClientKey             string            `toml:"tls_client_key"`
+	Mirror                bool              `toml:"mirror"`
+	TrashDirectory        string            `toml:"trash_directory"`
+	DeltaTransfers        bool              `toml:"delta_transfers"`
+	SyncRetries           int               `toml:"sync_retries"`
+	PreserveOwnership     bool              `toml:"preserve_ownership"`
+	LongPoll              bool              `toml:"long_poll"`
+	FullCompareEvery      int               `toml:"full_compare_every"`
+	BatchFiles            int               `toml:"batch_files"`
+	BatchFileSize         int64             `toml:"batch_file_size"`
+	TransferWorkers       int               `toml:"transfer_workers"`
+	MaxTransfers          int               `toml:"max_transfers"`
+	UIDMap                map[string]int    `toml:"uid_map"`
+	GIDMap                map[string]int    `toml:"gid_map"`
 }
 
 type Conf struct {
@@ -28,18 +52,49 @@ type Conf struct {
 	Cert                   string   `toml:"tls_cert"`
 	Key                    string   `toml:"tls_key"`
 	Ssl                    bool     `toml:"use_ssl"`
+	ClientCA               string   `toml:"tls_client_ca"`
+	TLSDirectory           string   `toml:"tls_directory"`
+	TLSHosts               []string `toml:"tls_hosts"`
 	NodeEndpoint           bool     `toml:"node_endpoint"`
 	HeartBeatTrackInterval string   `toml:"heartbeat_tracker_interval"`
 	HeartBeatOffline       string   `toml:"heartbeat_offline"`
 	LogTimeTrack           bool     `toml:"log_timetrack"`
 	Version                bool
-	CliConfigPath          string `toml:"cli_config_path"`
+	CliConfigPath          string              `toml:"cli_config_path"`
+	CacheWatch             bool                `toml:"cache_watch"`
+	CacheRescanInterval    string              `toml:"cache_rescan_interval"`
+	SymlinkPolicy          string              `toml:"symlink_policy"`
+	IgnoreFile             string              `toml:"ignore_file"`
+	Ignore                 []string            `toml:"ignore"`
+	IndexStateFile         string              `toml:"index_state_file"`
+	HashWorkers            int                 `toml:"hash_workers"`
+	HashRate               string              `toml:"hash_rate"`
+	HashAlgorithms         []string            `toml:"hash_algorithms"`
+	JournalSize            int                 `toml:"journal_size"`
+	LongPollTimeout        string              `toml:"long_poll_timeout"`
+	BandwidthLimit         []string            `toml:"bandwidth_limit"`
+	NodeBandwidthLimits    map[string][]string `toml:"node_bandwidth_limits"`
+	SignatureMaxAge        string              `toml:"signature_max_age"`
+	RequireSignatures      bool                `toml:"require_signatures"`
+	AdminToken             string              `toml:"admin_token"`
+	JoinTokensFile         string              `toml:"join_tokens_file"`
+	RequireJoinToken       bool                `toml:"require_join_token"`
+	RequireApproval        bool                `toml:"require_approval"`
 }
 
 var Config Conf
 
+//Symbolic links that point outside of the synced tree are handled according to Config.SymlinkPolicy
+const (
+	SymlinkPolicyPreserve = "preserve" //Sync the link as-is
+	SymlinkPolicySkip     = "skip"     //Leave the link out
+)
+
 func GetOptions() {
 	var configFile string
+	var hashAlgorithms string
+	var bandwidthLimit string
+	var tlsHosts string
 
 	//Misc command line flags
 	flag.StringVar(&configFile, "config", "", "Configuration file")
@@ -47,6 +102,20 @@ func GetOptions() {
 	flag.BoolVar(&Config.Version, "version", false, "Print version information and exit")
 	flag.StringVar(&Config.CliConfigPath, "cli-config", "etc/config.toml.cli", "Path to the command line configuration file")
 
+	flag.StringVar(&Config.SymlinkPolicy, "symlink-policy", "preserve",
+		"What to do with symbolic links that point outside of the tree: preserve or skip")
+	flag.StringVar(&Config.IgnoreFile, "ignore-file", ".autobdignore",
+		"Name of the files listing patterns to leave out of the tree below the directory they're in")
+	flag.StringVar(&Config.IndexStateFile, "index-state-file", ".autobd-index",
+		"Where to save file checksums, so unchanged files aren't rehashed after a restart (empty to disable)")
+	flag.IntVar(&Config.HashWorkers, "hash-workers", 0, "How many files to hash at the same time while indexing (0 uses -cores)")
+	flag.StringVar(&Config.HashRate, "hash-rate", "",
+		"Limit how fast files are read while indexing, e.g 100MB (empty for no limit)")
+	flag.StringVar(&hashAlgorithms, "hash-algorithms", "sha512",
+		"Comma separated hash algorithms: the ones a server indexes with, or a node's in order of preference")
+	flag.StringVar(&bandwidthLimit, "bandwidth-limit", "",
+		"Semicolon separated schedule of rates for the server's responses, or the node's downloads, e.g \"mon-fri 09:00-17:00 10MB;unlimited\"")
+
 	//Server command line flags
 	flag.StringVar(&Config.NodeListFile, "node-list-file", "", "Where to store the server's node list file")
 	flag.StringVar(&Config.Root, "root", "", "Root directory to serve (required). Must be absolute path")
@@ -54,10 +123,34 @@ func GetOptions() {
 	flag.StringVar(&Config.Cert, "tls-cert", "", "Path to TLS certificate to use")
 	flag.StringVar(&Config.Key, "tls-key", "", "Path to TLS key to use")
 	flag.BoolVar(&Config.Ssl, "ssl", true, "Use TLS/SSL")
+	flag.StringVar(&Config.TLSDirectory, "tls-directory", "",
+		"Where to keep the certificate authority and certificate generated when -tls-cert and -tls-key aren't set. Must be outside of -root (default $HOME/.autobd-tls)")
+	flag.StringVar(&tlsHosts, "tls-hosts", "",
+		"Comma separated host names and IP addresses to generate the certificate for, besides the host name")
+	flag.StringVar(&Config.ClientCA, "tls-client-ca", "",
+		"Require nodes to present a certificate signed by the CA certificates in this file (empty to not require one)")
 	flag.BoolVar(&Config.NodeEndpoint, "node-endpoint", false, "Enable or disable the /nodes endpoint that may reveal sensitive information")
 	flag.StringVar(&Config.HeartBeatTrackInterval, "heartbeat-track-interval", "30s", "How often update registered nodes status")
 	flag.StringVar(&Config.HeartBeatOffline, "heartbeat-offline", "5m", "How long a node can go without a heartbeat before it's marked offline")
 	flag.BoolVar(&Config.LogTimeTrack, "log-timetrack", true, "Enable or disable logging of utils/TimeTrack() (For benchmarking/debugging)")
+	flag.BoolVar(&Config.CacheWatch, "cache-watch", true, "Watch the root directory for changes and keep the index cache up to date")
+	flag.StringVar(&Config.CacheRescanInterval, "cache-rescan-interval", "10m",
+		"How often to rescan the whole root directory for changes that were missed (0 to disable)")
+	flag.IntVar(&Config.JournalSize, "journal-size", 10000,
+		"How many changes to remember for nodes asking what changed since their last sync")
+	flag.StringVar(&Config.LongPollTimeout, "long-poll-timeout", "60s",
+		"How long nodes waiting for changes are kept waiting before being told nothing changed")
+	flag.StringVar(&Config.AdminToken, "admin-token", "",
+		"Token admins authenticate to the /admin endpoints with (empty to disable them)")
+	flag.StringVar(&Config.JoinTokensFile, "join-tokens-file", ".tokens", "Where to store the join tokens minted for nodes")
+	flag.BoolVar(&Config.RequireJoinToken, "require-join-token", false,
+		"Only let new nodes enroll with a join token minted through the admin endpoints")
+	flag.BoolVar(&Config.RequireApproval, "require-approval", false,
+		"Hold new nodes as pending until an admin approves them through the admin endpoints")
+	flag.StringVar(&Config.SignatureMaxAge, "signature-max-age", "5m",
+		"How old a node's request signature can be before it's refused, allowing for clock differences")
+	flag.BoolVar(&Config.RequireSignatures, "require-signatures", true,
+		"Refuse unsigned requests from nodes that enrolled before they were given a secret")
 
 	//Node command line flags
 	flag.BoolVar(&Config.RunNode, "node", false, "Run as a node")
@@ -69,8 +162,54 @@ func GetOptions() {
 		"Ignore a mismatch in server and client versions")
 	flag.StringVar(&Config.NodeConfig.TargetDirectory, "target-directory", "/", "Which directory on the node to sync")
 	flag.StringVar(&Config.NodeConfig.UUIDPath, "uuid-path", ".uuid", "Where to store the node UUID")
+	flag.StringVar(&Config.NodeConfig.SecretPath, "secret-path", ".secrets", "Where to store the secrets the servers gave the node")
+	flag.StringVar(&Config.NodeConfig.ServerCA, "tls-server-ca", "",
+		"Verify servers against the CA certificates in this file, instead of pinning their certificates")
+	flag.StringVar(&Config.NodeConfig.PinsPath, "pins-path", ".pins",
+		"Where to store the fingerprints of server certificates pinned the first time the node connected")
+	flag.BoolVar(&Config.NodeConfig.TrustOnFirstUse, "trust-on-first-use", true,
+		"Pin the certificate of servers that aren't verified otherwise the first time the node connects to them")
+	flag.StringVar(&Config.NodeConfig.JoinToken, "join-token", "", "Join token to enroll with servers that require one")
+	flag.StringVar(&Config.NodeConfig.ClientCert, "tls-client-cert", "", "Certificate the node presents to servers that require one")
+	flag.StringVar(&Config.NodeConfig.ClientKey, "tls-client-key", "", "Key of the certificate the node presents to servers")
+	flag.BoolVar(&Config.NodeConfig.Mirror, "mirror", false, "Remove local files and directories that no longer exist on any of the servers")
+	flag.StringVar(&Config.NodeConfig.TrashDirectory, "trash-directory", "",
+		"Move files removed in mirror mode here instead of deleting them")
+	flag.BoolVar(&Config.NodeConfig.DeltaTransfers, "delta-transfers", false,
+		"Only transfer the changed blocks of files the node already has a copy of")
+	flag.IntVar(&Config.NodeConfig.SyncRetries, "sync-retries", 3,
+		"How many times to retry a transfer that failed or didn't match the server's checksum")
+	flag.BoolVar(&Config.NodeConfig.PreserveOwnership, "preserve-ownership", true,
+		"Set the owner and group of synced files to the server's (only when running as root)")
+	flag.BoolVar(&Config.NodeConfig.LongPoll, "long-poll", false,
+		"Wait for the servers to report changes and sync right away, instead of every -update-interval")
+	flag.IntVar(&Config.NodeConfig.FullCompareEvery, "full-compare-every", 10,
+		"Compare the whole tree every this many syncs, even if nothing changed on the server (1 compares every sync)")
+	flag.IntVar(&Config.NodeConfig.BatchFiles, "batch-files", 256,
+		"How many small files to fetch with a single request (0 fetches every file on its own)")
+	flag.Int64Var(&Config.NodeConfig.BatchFileSize, "batch-file-size", 64*1024,
+		"Files up to this many bytes are fetched in batches of -batch-files")
+	flag.IntVar(&Config.NodeConfig.TransferWorkers, "transfer-workers", 4,
+		"How many transfers to run at the same time with each server")
+	flag.IntVar(&Config.NodeConfig.MaxTransfers, "max-transfers", 0,
+		"How many transfers to run at the same time across all servers (0 for no limit beyond -transfer-workers)")
 
 	flag.Parse()
+	for _, algorithm := range strings.Split(hashAlgorithms, ",") {
+		if algorithm = strings.TrimSpace(algorithm); algorithm != "" {
+			Config.HashAlgorithms = append(Config.HashAlgorithms, algorithm)
+		}
+	}
+	for _, host := range strings.Split(tlsHosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			Config.TLSHosts = append(Config.TLSHosts, host)
+		}
+	}
+	for _, rule := range strings.Split(bandwidthLimit, ";") {
+		if rule = strings.TrimSpace(rule); rule != "" {
+			Config.BandwidthLimit = append(Config.BandwidthLimit, rule)
+		}
+	}
 
 	if configFile != "" {
 		if _, err := toml.DecodeFile(configFile, &Config); err != nil {
@@ -80,6 +219,38 @@ func GetOptions() {
 		fmt.Printf("Configration file options in %s overriding command line options\n", configFile)
 	}
 
+	if Config.SymlinkPolicy != SymlinkPolicyPreserve && Config.SymlinkPolicy != SymlinkPolicySkip {
+		fmt.Printf("Invalid symlink policy '%s', must be '%s' or '%s'\n", Config.SymlinkPolicy,
+			SymlinkPolicyPreserve, SymlinkPolicySkip)
+		os.Exit(-1)
+	}
+
+	if _, err := throttle.ParseRate(Config.HashRate); err != nil {
+		fmt.Printf("Invalid hash rate: %s\n", err.Error())
+		os.Exit(-1)
+	}
+
+	if _, err := throttle.ParseSchedule(Config.BandwidthLimit); err != nil {
+		fmt.Printf("Invalid bandwidth limit: %s\n", err.Error())
+		os.Exit(-1)
+	}
+	for uuid, schedule := range Config.NodeBandwidthLimits {
+		if _, err := throttle.ParseSchedule(schedule); err != nil {
+			fmt.Printf("Invalid bandwidth limit for node %s: %s\n", uuid, err.Error())
+			os.Exit(-1)
+		}
+	}
+
+	if _, err := time.ParseDuration(Config.SignatureMaxAge); err != nil {
+		fmt.Printf("Invalid signature max age: %s\n", err.Error())
+		os.Exit(-1)
+	}
+
+	if Config.ClientCA != "" && Config.Ssl == false {
+		fmt.Printf("Node certificates can only be required when using TLS/SSL\n")
+		os.Exit(-1)
+	}
+
 	if Config.RunNode == true && len(Config.NodeConfig.Servers) == 0 {
 		if Config.Server == "" {
 			panic("Must specify seed server when running as node")
@@ -2,24 +2,44 @@ package packing
 
 import (
 	"archive/tar"
+	log "github.com/Sirupsen/logrus"
+	"github.com/tywkeene/autobd/ignore"
+	"github.com/tywkeene/autobd/index"
 	"github.com/tywkeene/autobd/options"
+	"github.com/tywkeene/autobd/utils"
 	"io"
 	"os"
 	"path/filepath"
 )
 
-func UnpackDir(source io.Reader) error {
+//VerifyFunc checks the unpacked content of the file name, stored at tempPath, before it's
+//moved into place
+type VerifyFunc func(name string, tempPath string) error
+
+//UnpackDir unpacks the tarball read from source as it's received, so memory use doesn't
+//depend on the size of the files in it. Each file is written atomically, and if verify is not
+//nil it must accept the file before it replaces the existing one.
+//The mode, modification time and ownership recorded in the tarball are applied to everything unpacked.
+//Entries, and the targets of hard links, must be inside of root, or unpacking fails
+func UnpackDir(source io.Reader, root string, verify VerifyFunc) error {
 	tr := tar.NewReader(source)
+	//Unpacking files changes the modification time of their directory, so directories
+	//are only given their recorded metadata once everything is unpacked
+	dirs := make([]*tar.Header, 0)
 
 	for {
 		header, err := tr.Next()
-		if err != nil {
-			return err
-		} else if err == io.EOF {
+		if err == io.EOF {
 			break
+		} else if err != nil {
+			return err
 		}
 
-		filename := header.Name
+		filename, err := utils.ConfinePath(root, header.Name)
+		if err != nil {
+			return err
+		}
+		header.Name = filename
 
 		switch header.Typeflag {
 		case tar.TypeDir:
@@ -27,29 +47,73 @@ func UnpackDir(source io.Reader) error {
 			if err != nil {
 				return err
 			}
+			dirs = append(dirs, header)
 		case tar.TypeReg:
-			writer, err := os.Create(filename)
+			if err := unpackFile(header, tr, verify); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := unpackSymlink(header); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			existing, err := utils.ConfinePath(root, header.Linkname)
 			if err != nil {
 				return err
 			}
-
-			io.Copy(writer, tr)
-			if err = os.Chmod(filename, os.FileMode(header.Mode)); err != nil {
+			if err := utils.Link(existing, filename); err != nil {
 				return err
 			}
-			writer.Close()
 		}
 	}
+	//Children come after their parents in the tarball, so go backwards to set the
+	//children's metadata first
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := setMetadata(dirs[i].Name, dirs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setMetadata(filename string, header *tar.Header) error {
+	return utils.SetMetadata(filename, header.FileInfo().Mode(), header.ModTime, header.Uid, header.Gid)
+}
+
+func unpackSymlink(header *tar.Header) error {
+	if options.Config.SymlinkPolicy == options.SymlinkPolicySkip &&
+		utils.LinkEscapes(header.Name, header.Linkname) == true {
+		log.Warnf("Skipping symbolic link pointing outside of the tree: %s -> %s", header.Name, header.Linkname)
+		return nil
+	}
+	if err := utils.Symlink(header.Linkname, header.Name); err != nil {
+		return err
+	}
+	if utils.CanChown() == true {
+		uid, gid := utils.MapOwner(header.Uid, header.Gid)
+		return os.Lchown(header.Name, uid, gid)
+	}
 	return nil
 }
 
+func unpackFile(header *tar.Header, source io.Reader, verify VerifyFunc) error {
+	return utils.WriteFile(header.Name, source, func(tempPath string) error {
+		if verify != nil {
+			if err := verify(header.Name, tempPath); err != nil {
+				return err
+			}
+		}
+		return setMetadata(tempPath, header)
+	})
+}
+
 //addTarFile() and PackDir() are from https://github.com/pivotal-golang/archiver
 //I was originally going to bring in the whole package as a dependency but it turns out
 //the extractor package doesn't entirely work the way I thought. This works, so I'm putting it
 //in here to avoid the whole dependency thing until I can fix it.
 //TL;DR: This isn't my code.
 
-func addTarFile(path string, name string, tw *tar.Writer) error {
+func addTarFile(path string, name string, tw *tar.Writer, links map[string]string) error {
 	fi, err := os.Lstat(path)
 	if err != nil {
 		return err
@@ -75,6 +139,16 @@ func addTarFile(path string, name string, tw *tar.Writer) error {
 		hdr.Name = filepath.ToSlash(path)
 	}
 	hdr.Name = filepath.ToSlash(name)
+	//Hard links to content that's already in the tarball only reference the first link
+	if group := index.FileLinkGroup(fi); group != "" && hdr.Typeflag == tar.TypeReg {
+		if first, ok := links[group]; ok == true {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = first
+			hdr.Size = 0
+		} else {
+			links[group] = hdr.Name
+		}
+	}
 	if err := tw.WriteHeader(hdr); err != nil {
 		return err
 	}
@@ -94,6 +168,7 @@ func addTarFile(path string, name string, tw *tar.Writer) error {
 	return nil
 }
 
+//PackDir writes a tarball of srcPath to dest, leaving out what the ignore rules exclude
 func PackDir(srcPath string, dest io.Writer) error {
 	absolutePath, err := filepath.Abs(srcPath)
 	if err != nil {
@@ -101,6 +176,9 @@ func PackDir(srcPath string, dest io.Writer) error {
 	}
 	tw := tar.NewWriter(dest)
 	defer tw.Close()
+	links := make(map[string]string)
+	//The ignore rules in effect inside of each directory packed so far
+	rules := make(map[string]*ignore.Rules)
 
 	err = filepath.Walk(absolutePath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
@@ -111,8 +189,38 @@ func PackDir(srcPath string, dest io.Writer) error {
 		if err != nil {
 			return err
 		}
-		return addTarFile(path, relativePath, tw)
+		if path == absolutePath {
+			rules[relativePath], _ = ignore.For(relativePath)
+		} else if parent := rules[filepath.Dir(relativePath)]; parent.Match(relativePath, info.IsDir()) == true {
+			if info.IsDir() == true {
+				return filepath.SkipDir
+			}
+			return nil
+		} else if info.IsDir() == true {
+			rules[relativePath] = parent.Load(relativePath)
+		}
+		if info.Mode()&os.ModeSymlink != 0 && options.Config.SymlinkPolicy == options.SymlinkPolicySkip {
+			link, err := os.Readlink(path)
+			if err != nil || utils.LinkEscapes(relativePath, link) == true {
+				return nil
+			}
+		}
+		return addTarFile(path, relativePath, tw, links)
 	})
 
 	return err
 }
+
+//PackFiles writes a tarball of the files named in names to dest, in that order. Hard links
+//between them are packed as links to the first one
+func PackFiles(names []string, dest io.Writer) error {
+	tw := tar.NewWriter(dest)
+	defer tw.Close()
+	links := make(map[string]string)
+	for _, name := range names {
+		if err := addTarFile(name, name, tw, links); err != nil {
+			return err
+		}
+	}
+	return nil
+}
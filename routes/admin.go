@@ -0,0 +1,228 @@
+package routes
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/tywkeene/autobd/index"
+	"github.com/tywkeene/autobd/nodelist"
+	"github.com/tywkeene/autobd/options"
+	"github.com/tywkeene/autobd/tokens"
+	"github.com/tywkeene/autobd/utils"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//MintRequest is what the "/admin/mint" API endpoint takes
+type MintRequest struct {
+	ExpiresIn string   `json:"expires_in"` //How long the token is valid for, 24h if not given
+	MaxUses   int      `json:"max_uses"`   //How many nodes the token can enroll, one if not given
+	Subtree   string   `json:"subtree"`    //Only enroll nodes syncing this directory or below it
+	Labels    []string `json:"labels"`     //Labels to give the nodes the token enrolls, informational only
+}
+
+//writeJSON writes value to the client encoded in json
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	serial, _ := json.MarshalIndent(value, "  ", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	setDefaultResponseHeaders(w)
+	io.WriteString(w, string(serial))
+}
+
+//Make sure the request is authorized with options.Config.AdminToken, sent as a bearer token
+//in the Authorization http header
+func AdminHandler(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		errHandle := utils.NewHttpErrorHandle("api/AdminHandler()", w, r)
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if options.Config.AdminToken == "" ||
+			subtle.ConstantTimeCompare([]byte(given), []byte(options.Config.AdminToken)) != 1 {
+			errHandle.Handle(fmt.Errorf("Invalid admin token"), http.StatusUnauthorized, utils.ErrorActionErr)
+			return
+		}
+		fn(w, r)
+	}
+}
+
+//AdminListTokens() is the http handler for the "/admin/tokens" API endpoint
+//It returns every join token minted so far, without the tokens themselves, encoded in json
+func AdminListTokens(w http.ResponseWriter, r *http.Request) {
+	defer utils.TimeTrack(time.Now(), "api/AdminListTokens()")
+	errHandle := utils.NewHttpErrorHandle("api/AdminListTokens()", w, r)
+	LogHttp(r)
+	if validateRequestMethod(errHandle, "GET") == false {
+		return
+	}
+	writeJSON(w, tokens.List())
+}
+
+//AdminMintToken() is the http handler for the "/admin/mint" API endpoint
+//It takes a MintRequest encoded in json, and returns the new join token as a tokens.Minted encoded in json.
+//The token itself is never shown again
+func AdminMintToken(w http.ResponseWriter, r *http.Request) {
+	defer utils.TimeTrack(time.Now(), "api/AdminMintToken()")
+	errHandle := utils.NewHttpErrorHandle("api/AdminMintToken()", w, r)
+	LogHttp(r)
+	if validateRequestMethod(errHandle, "POST") == false {
+		return
+	}
+	serial, err := ioutil.ReadAll(r.Body)
+	if errHandle.Handle(err, http.StatusInternalServerError, utils.ErrorActionErr) {
+		return
+	}
+	var request MintRequest
+	err = json.Unmarshal(serial, &request)
+	if errHandle.Handle(err, http.StatusBadRequest, utils.ErrorActionErr) {
+		return
+	}
+	if request.ExpiresIn == "" {
+		request.ExpiresIn = "24h"
+	}
+	if request.MaxUses == 0 {
+		request.MaxUses = 1
+	}
+	validFor, err := time.ParseDuration(request.ExpiresIn)
+	if errHandle.Handle(err, http.StatusBadRequest, utils.ErrorActionErr) {
+		return
+	}
+	if request.Subtree != "" {
+		request.Subtree, err = utils.ConfinePath("./", request.Subtree)
+		if errHandle.Handle(err, http.StatusBadRequest, utils.ErrorActionErr) {
+			return
+		}
+		_, err = index.ValidateDirectory(request.Subtree)
+		if errHandle.Handle(err, http.StatusBadRequest, utils.ErrorActionErr) {
+			return
+		}
+	}
+	minted, err := tokens.Mint(validFor, request.MaxUses, request.Subtree, request.Labels)
+	if errHandle.Handle(err, http.StatusBadRequest, utils.ErrorActionErr) {
+		return
+	}
+	log.Infof("Minted join token %s for %d nodes, expiring %s", minted.ID, minted.MaxUses, minted.Expires.Format(time.RFC850))
+	writeJSON(w, minted)
+}
+
+//AdminRevokeToken() is the http handler for the "/admin/revoke" API endpoint
+//It takes the id of a join token as the url parameter "id", and removes the token so it can't be used anymore
+func AdminRevokeToken(w http.ResponseWriter, r *http.Request) {
+	defer utils.TimeTrack(time.Now(), "api/AdminRevokeToken()")
+	errHandle := utils.NewHttpErrorHandle("api/AdminRevokeToken()", w, r)
+	LogHttp(r)
+	if validateRequestMethod(errHandle, "POST") == false {
+		return
+	}
+	id, _ := GetQueryValue("id", w, r)
+	if id == "" {
+		errHandle.Handle(fmt.Errorf("Must specify token id"), http.StatusBadRequest, utils.ErrorActionErr)
+		return
+	}
+	revoked, err := tokens.Revoke(id)
+	if errHandle.Handle(err, http.StatusInternalServerError, utils.ErrorActionErr) {
+		return
+	}
+	if revoked == false {
+		errHandle.Handle(fmt.Errorf("No such token"), http.StatusNotFound, utils.ErrorActionErr)
+		return
+	}
+	log.Infof("Revoked join token %s", id)
+	setDefaultResponseHeaders(w)
+	w.WriteHeader(http.StatusOK)
+}
+
+//AdminListNodes() is the http handler for the "/admin/nodes" API endpoint
+//It returns the registered nodes, without their secrets, encoded in json. The url parameter "status" limits
+//them to the nodes with that approval status, e.g "pending" for the ones waiting to be approved
+func AdminListNodes(w http.ResponseWriter, r *http.Request) {
+	defer utils.TimeTrack(time.Now(), "api/AdminListNodes()")
+	errHandle := utils.NewHttpErrorHandle("api/AdminListNodes()", w, r)
+	LogHttp(r)
+	if validateRequestMethod(errHandle, "GET") == false {
+		return
+	}
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "", nodelist.StatusPending, nodelist.StatusApproved, nodelist.StatusRejected:
+	default:
+		errHandle.Handle(fmt.Errorf("Unknown node status '%s'", status), http.StatusBadRequest, utils.ErrorActionErr)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	setDefaultResponseHeaders(w)
+	io.WriteString(w, string(nodelist.GetNodelistJsonByStatus(status)))
+}
+
+//setNodeApproval sets the approval status of the node named by the url parameter "uuid", and writes
+//the node list so the decision is kept
+func setNodeApproval(errHandle *utils.HttpErrorHandler, w http.ResponseWriter, r *http.Request, status string) {
+	if validateRequestMethod(errHandle, "POST") == false {
+		return
+	}
+	uuid, _ := GetQueryValue("uuid", w, r)
+	if uuid == "" {
+		errHandle.Handle(fmt.Errorf("Must specify node uuid"), http.StatusBadRequest, utils.ErrorActionErr)
+		return
+	}
+	found, err := nodelist.SetNodeApproval(uuid, status, options.Config.NodeListFile)
+	if found == false {
+		errHandle.Handle(fmt.Errorf("No such node"), http.StatusNotFound, utils.ErrorActionErr)
+		return
+	}
+	if errHandle.Handle(err, http.StatusInternalServerError, utils.ErrorActionErr) {
+		return
+	}
+	log.Infof("Node (%s) was %s", uuid, status)
+	setDefaultResponseHeaders(w)
+	w.WriteHeader(http.StatusOK)
+}
+
+//AdminApproveNode() is the http handler for the "/admin/approve" API endpoint
+//It takes the uuid of a node as the url parameter "uuid", and lets the node fetch data from the server
+func AdminApproveNode(w http.ResponseWriter, r *http.Request) {
+	defer utils.TimeTrack(time.Now(), "api/AdminApproveNode()")
+	errHandle := utils.NewHttpErrorHandle("api/AdminApproveNode()", w, r)
+	LogHttp(r)
+	setNodeApproval(errHandle, w, r, nodelist.StatusApproved)
+}
+
+//AdminRejectNode() is the http handler for the "/admin/reject" API endpoint
+//It takes the uuid of a node as the url parameter "uuid", and refuses the node everything from then on
+func AdminRejectNode(w http.ResponseWriter, r *http.Request) {
+	defer utils.TimeTrack(time.Now(), "api/AdminRejectNode()")
+	errHandle := utils.NewHttpErrorHandle("api/AdminRejectNode()", w, r)
+	LogHttp(r)
+	setNodeApproval(errHandle, w, r, nodelist.StatusRejected)
+}
+
+//AdminResetNode() is the http handler for the "/admin/reset" API endpoint
+//It takes the uuid of a node as the url parameter "uuid", and removes the node's secret, so a node that lost
+//it can enroll again. When join tokens or approval are required, the node has to bring a join token when it
+//does, or it's held until an admin approves it
+func AdminResetNode(w http.ResponseWriter, r *http.Request) {
+	defer utils.TimeTrack(time.Now(), "api/AdminResetNode()")
+	errHandle := utils.NewHttpErrorHandle("api/AdminResetNode()", w, r)
+	LogHttp(r)
+	if validateRequestMethod(errHandle, "POST") == false {
+		return
+	}
+	uuid, _ := GetQueryValue("uuid", w, r)
+	if uuid == "" {
+		errHandle.Handle(fmt.Errorf("Must specify node uuid"), http.StatusBadRequest, utils.ErrorActionErr)
+		return
+	}
+	found, err := nodelist.ResetNodeSecret(uuid, options.Config.NodeListFile)
+	if found == false {
+		errHandle.Handle(fmt.Errorf("No such node"), http.StatusNotFound, utils.ErrorActionErr)
+		return
+	}
+	if errHandle.Handle(err, http.StatusInternalServerError, utils.ErrorActionErr) {
+		return
+	}
+	log.Infof("Secret of node (%s) was reset", uuid)
+	setDefaultResponseHeaders(w)
+	w.WriteHeader(http.StatusOK)
+}
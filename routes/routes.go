@@ -5,20 +5,30 @@ package routes
 
 import (
 	"compress/gzip"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
+	"github.com/tywkeene/autobd/auth"
 	"github.com/tywkeene/autobd/cache"
+	"github.com/tywkeene/autobd/certs"
+	"github.com/tywkeene/autobd/delta"
+	"github.com/tywkeene/autobd/ignore"
+	"github.com/tywkeene/autobd/index"
 	"github.com/tywkeene/autobd/nodelist"
 	"github.com/tywkeene/autobd/options"
 	"github.com/tywkeene/autobd/packing"
+	"github.com/tywkeene/autobd/throttle"
+	"github.com/tywkeene/autobd/tokens"
 	"github.com/tywkeene/autobd/utils"
 	"github.com/tywkeene/autobd/version"
+	"hash"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"strconv"
 	"strings"
 	"time"
@@ -33,6 +43,23 @@ func (w gzipResponseWriter) Write(b []byte) (int, error) {
 	return w.Writer.Write(b)
 }
 
+//Flush sends what was compressed so far, so streamed responses get through as they're written
+func (w gzipResponseWriter) Flush() {
+	if gz, ok := w.Writer.(*gzip.Writer); ok == true {
+		gz.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok == true {
+		flusher.Flush()
+	}
+}
+
+//Content-Length is set by handlers like http.ServeContent for the uncompressed content,
+//which doesn't match what actually gets written once it's gzip'd
+func (w gzipResponseWriter) WriteHeader(status int) {
+	w.ResponseWriter.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(status)
+}
+
 //Handle and make sure the client wants or can handle gzip, and replace the writer if it
 //can, if not, simply use the normal http.ResponseWriter
 func GzipHandler(fn http.HandlerFunc) http.HandlerFunc {
@@ -49,6 +76,175 @@ func GzipHandler(fn http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+type limitedResponseWriter struct {
+	io.Writer
+	http.ResponseWriter
+}
+
+func (w limitedResponseWriter) Write(b []byte) (int, error) {
+	return w.Writer.Write(b)
+}
+
+//Flush lets streamed responses through as they're written while a bandwidth limit applies
+func (w limitedResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok == true {
+		flusher.Flush()
+	}
+}
+
+//Limits the bandwidth used by all responses together, nil for no limit
+var bandwidthLimiter *throttle.Limiter
+
+//Limits the bandwidth used by the responses to each node, indexed by node UUID
+var nodeLimiters = make(map[string]*throttle.Limiter)
+
+//setupBandwidthLimits creates the limiters for options.Config.BandwidthLimit and options.Config.NodeBandwidthLimits
+func setupBandwidthLimits() {
+	schedule, err := throttle.ParseSchedule(options.Config.BandwidthLimit)
+	utils.HandleError(err, utils.ErrorActionErr)
+	bandwidthLimiter = throttle.NewScheduledLimiter(schedule)
+	for uuid, rules := range options.Config.NodeBandwidthLimits {
+		schedule, err := throttle.ParseSchedule(rules)
+		if utils.HandleError(err, utils.ErrorActionErr) == false {
+			nodeLimiters[uuid] = throttle.NewScheduledLimiter(schedule)
+		}
+	}
+}
+
+//Limit the rate the response is written at to both the server's bandwidth limit, and the limit for
+//the node making the request. Wraps GzipHandler(), so the limit applies to the bytes actually sent
+func ThrottleHandler(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		uuid, _ := GetQueryValue("uuid", w, r)
+		nodeLimiter := nodeLimiters[uuid]
+		if bandwidthLimiter == nil && nodeLimiter == nil {
+			fn(w, r)
+			return
+		}
+		limited := throttle.Writer(throttle.Writer(w, bandwidthLimiter), nodeLimiter)
+		fn(limitedResponseWriter{Writer: limited, ResponseWriter: w}, r)
+	}
+}
+
+//signatureMaxAge returns how old a request signature can be before it's refused
+func signatureMaxAge() time.Duration {
+	maxAge, err := time.ParseDuration(options.Config.SignatureMaxAge)
+	if err != nil {
+		return 0
+	}
+	return maxAge
+}
+
+//signatureRequired reports whether requests from node have to be signed. Nodes that enrolled
+//before nodes were given secrets can only sign once they identify again
+func signatureRequired(node *nodelist.Node) bool {
+	return node.Secret != "" || options.Config.RequireSignatures == true
+}
+
+//checkIdentity makes sure the certificate presented with r belongs to node, when the server requires nodes
+//to present one. Nodes that enrolled before that are bound to the first certificate they present
+func checkIdentity(node *nodelist.Node, r *http.Request) error {
+	if options.Config.ClientCA == "" {
+		return nil
+	}
+	identity := certs.Identity(r)
+	if identity == "" {
+		return fmt.Errorf("No verified certificate with a common name")
+	}
+	if node.Identity == "" {
+		node.Identity = identity
+		log.Infof("Node (%s) bound to certificate (%s)", node.ShortUUID(), identity)
+		return nodelist.WriteNodeList(options.Config.NodeListFile)
+	} else if node.Identity != identity {
+		return fmt.Errorf("Certificate (%s) doesn't belong to the node", identity)
+	}
+	return nil
+}
+
+//checkSubtree makes sure name is inside the directory node was enrolled for, if its join token limited it to one
+func checkSubtree(node *nodelist.Node, name string) error {
+	if node == nil || node.Subtree == "" {
+		return nil
+	}
+	if _, err := utils.ConfinePath(node.Subtree, name); err != nil {
+		return fmt.Errorf("Path '%s' is outside of the directory the node was enrolled for", name)
+	}
+	return nil
+}
+
+//Make sure the request comes from a registered node, and is signed with the secret the node was given
+//when it enrolled. The node is named by the signature, or the uuid query parameter of unsigned requests.
+//The "dir" and "grab" query parameters have to be inside of the directory the node was enrolled for
+func AuthHandler(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		errHandle := utils.NewHttpErrorHandle("api/AuthHandler()", w, r)
+		signer := r.Header.Get(auth.HeaderNode)
+		uuid := r.URL.Query().Get("uuid")
+		if signer != "" && uuid != "" && signer != uuid {
+			errHandle.Handle(fmt.Errorf("Request signed by another node"), http.StatusUnauthorized, utils.ErrorActionErr)
+			return
+		} else if signer != "" {
+			uuid = signer
+		}
+		node := nodelist.GetNodeByUUID(uuid)
+		if node == nil {
+			//The heartbeat of an unsigned node names it in the body, HeartBeat() validates it
+			if uuid == "" && options.Config.RequireSignatures == false {
+				fn(w, r)
+				return
+			}
+			errHandle.Handle(fmt.Errorf("Invalid node UUID"), http.StatusUnauthorized, utils.ErrorActionErr)
+			return
+		}
+		if errHandle.Handle(checkIdentity(node, r), http.StatusUnauthorized, utils.ErrorActionErr) == true {
+			return
+		}
+		if signer == "" && signatureRequired(node) == true {
+			errHandle.Handle(fmt.Errorf("Request is not signed"), http.StatusUnauthorized, utils.ErrorActionErr)
+			return
+		} else if signer != "" {
+			if node.Secret == "" {
+				errHandle.Handle(fmt.Errorf("Node has no secret, it has to identify again"), http.StatusUnauthorized,
+					utils.ErrorActionErr)
+				return
+			}
+			err := auth.VerifyRequest(r, node.Secret, signatureMaxAge())
+			if errHandle.Handle(err, http.StatusUnauthorized, utils.ErrorActionErr) == true {
+				return
+			}
+		}
+		for _, name := range []string{r.URL.Query().Get("dir"), r.URL.Query().Get("grab")} {
+			if name != "" && errHandle.Handle(checkSubtree(node, name), http.StatusForbidden, utils.ErrorActionErr) == true {
+				return
+			}
+		}
+		fn(w, r)
+	}
+}
+
+//Make sure the node the request comes from was approved by an admin. Pending and rejected nodes are refused.
+//Only wraps handlers behind AuthHandler(), which already made sure the node is registered
+func ApprovedHandler(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		errHandle := utils.NewHttpErrorHandle("api/ApprovedHandler()", w, r)
+		uuid := r.Header.Get(auth.HeaderNode)
+		if uuid == "" {
+			uuid = r.URL.Query().Get("uuid")
+		}
+		node := nodelist.GetNodeByUUID(uuid)
+		if node == nil && options.Config.RequireApproval == true {
+			errHandle.Handle(fmt.Errorf("Invalid node UUID"), http.StatusUnauthorized, utils.ErrorActionErr)
+			return
+		}
+		if node != nil && node.Approved() == false {
+			errHandle.Handle(fmt.Errorf("Node is %s by the server's admin", node.ApprovalStatus()),
+				http.StatusForbidden, utils.ErrorActionErr)
+			return
+		}
+		fn(w, r)
+	}
+}
+
 func LogHttp(r *http.Request) {
 	log.Printf("%s %s %s %s", r.Method, r.URL, r.RemoteAddr, r.UserAgent())
 }
@@ -86,7 +282,8 @@ func GetQueryValue(name string, w http.ResponseWriter, r *http.Request) (string,
 //It takes the requested directory passed as a url parameter "dir" i.e "/index?dir=/"
 //
 //It will then generate a index by calling api.GetIndex(), then writes it to the client as a
-//map[string]*index.Index encoded in json
+//map[string]*index.Index encoded in json. The optional url parameter "depth" limits how many
+//levels of the tree are included, so a node can fetch only the subtrees whose checksums differ
 func ServeIndex(w http.ResponseWriter, r *http.Request) {
 	defer utils.TimeTrack(time.Now(), "api/ServeIndex()")
 	errHandle := utils.NewHttpErrorHandle("api/ServeIndex()", w, r)
@@ -109,16 +306,179 @@ func ServeIndex(w http.ResponseWriter, r *http.Request) {
 		errHandle.Handle(fmt.Errorf("Must specify directory"), http.StatusBadRequest, utils.ErrorActionErr)
 		return
 	}
-	dirIndex, err := cache.Get(dir)
+	var depth int
+	if value, _ := GetQueryValue("depth", w, r); value != "" {
+		depth, err = strconv.Atoi(value)
+		if errHandle.Handle(err, http.StatusBadRequest, utils.ErrorActionErr) == true {
+			return
+		}
+	}
+	dirIndex, err := cache.Get(dir, nodeAlgorithm(uuid))
 	if errHandle.Handle(err, http.StatusInternalServerError, utils.ErrorActionErr) == true {
 		return
 	}
+	dirIndex = index.Trim(dirIndex, depth)
 	serial, _ := json.MarshalIndent(&dirIndex, "  ", "  ")
 	w.Header().Set("Content-Type", "application/json")
 	setDefaultResponseHeaders(w)
 	io.WriteString(w, string(serial))
 }
 
+//changesRequest holds the url parameters of the "/changes" and "/wait" API endpoints
+type changesRequest struct {
+	uuid    string
+	dir     string
+	journal string
+	since   uint64
+}
+
+//parseChangesRequest validates the url parameters of the "/changes" and "/wait" API endpoints.
+//On error, the error is written to the client and false is returned
+func parseChangesRequest(errHandle *utils.HttpErrorHandler, w http.ResponseWriter, r *http.Request) (*changesRequest, bool) {
+	uuid, err := GetQueryValue("uuid", w, r)
+	if errHandle.Handle(err, http.StatusInternalServerError, utils.ErrorActionErr) == true {
+		return nil, false
+	}
+	if nodelist.ValidateNode(uuid) == false {
+		errHandle.Handle(fmt.Errorf("Invalid node UUID"), http.StatusUnauthorized, utils.ErrorActionErr)
+		return nil, false
+	}
+
+	dir, err := GetQueryValue("dir", w, r)
+	if dir == "" {
+		errHandle.Handle(fmt.Errorf("Must specify directory"), http.StatusBadRequest, utils.ErrorActionErr)
+		return nil, false
+	}
+	dir, err = index.ValidateDirectory(dir)
+	if errHandle.Handle(err, http.StatusBadRequest, utils.ErrorActionErr) == true {
+		return nil, false
+	}
+	journal, _ := GetQueryValue("journal", w, r)
+	var since uint64
+	if value, _ := GetQueryValue("since", w, r); value != "" {
+		since, err = strconv.ParseUint(value, 10, 64)
+		if errHandle.Handle(err, http.StatusBadRequest, utils.ErrorActionErr) == true {
+			return nil, false
+		}
+	}
+	return &changesRequest{uuid: uuid, dir: dir, journal: journal, since: since}, true
+}
+
+//getChangeSet returns the changes below request.dir since request.since, or the whole index
+//of request.dir if the journal can't tell
+func getChangeSet(request *changesRequest) (*index.ChangeSet, error) {
+	var err error
+	changes, latest, complete := cache.Changes(request.since)
+	changeSet := &index.ChangeSet{Journal: cache.JournalID(), Sequence: latest, Changes: make([]index.Change, 0)}
+	if complete == true && request.journal == changeSet.Journal {
+		changeSet.Changes = cache.ChangesBelow(changes, request.dir)
+		return changeSet, nil
+	}
+	changeSet.Index, err = cache.Get(request.dir, nodeAlgorithm(request.uuid))
+	if err != nil {
+		return nil, err
+	}
+	return changeSet, nil
+}
+
+func writeChangeSet(w http.ResponseWriter, changeSet *index.ChangeSet) {
+	serial, _ := json.Marshal(changeSet)
+	w.Header().Set("Content-Type", "application/json")
+	setDefaultResponseHeaders(w)
+	io.WriteString(w, string(serial))
+}
+
+//ServeChanges() is the http handler for the "/changes" API endpoint.
+//It takes the same "dir" url parameter as ServeIndex(), along with the "journal" and "since" url parameters
+//a node got from its last request, and writes the changes below dir since then as an index.ChangeSet encoded
+//in json. If the journal doesn't go back that far, or was restarted, the whole index of dir is sent instead
+func ServeChanges(w http.ResponseWriter, r *http.Request) {
+	defer utils.TimeTrack(time.Now(), "api/ServeChanges()")
+	errHandle := utils.NewHttpErrorHandle("api/ServeChanges()", w, r)
+	LogHttp(r)
+	if validateRequestMethod(errHandle, "GET") == false {
+		return
+	}
+	request, ok := parseChangesRequest(errHandle, w, r)
+	if ok == false {
+		return
+	}
+	changeSet, err := getChangeSet(request)
+	if errHandle.Handle(err, http.StatusInternalServerError, utils.ErrorActionErr) == true {
+		return
+	}
+	writeChangeSet(w, changeSet)
+}
+
+//ServeWait() is the http handler for the "/wait" API endpoint.
+//It takes the same url parameters as ServeChanges(), and writes the same response, but if nothing
+//below dir changed yet, it waits until something does, or until options.Config.LongPollTimeout
+//passes, before answering. Nodes use it to sync as soon as something changes
+func ServeWait(w http.ResponseWriter, r *http.Request) {
+	errHandle := utils.NewHttpErrorHandle("api/ServeWait()", w, r)
+	LogHttp(r)
+	if validateRequestMethod(errHandle, "GET") == false {
+		return
+	}
+	request, ok := parseChangesRequest(errHandle, w, r)
+	if ok == false {
+		return
+	}
+	timeout, err := time.ParseDuration(options.Config.LongPollTimeout)
+	if errHandle.Handle(err, http.StatusInternalServerError, utils.ErrorActionErr) == true {
+		return
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		//Taken before looking at the journal, so changes recorded in between aren't missed
+		updated := cache.Updated()
+		changeSet, err := getChangeSet(request)
+		if errHandle.Handle(err, http.StatusInternalServerError, utils.ErrorActionErr) == true {
+			return
+		}
+		if len(changeSet.Changes) > 0 || changeSet.Index != nil {
+			writeChangeSet(w, changeSet)
+			return
+		}
+		select {
+		case <-updated:
+		case <-timer.C:
+			writeChangeSet(w, changeSet)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+//Fingerprint nodes pin for the server's certificate, empty when it isn't using TLS. Set by server.Launch()
+var CertificateFingerprint string
+
+//FingerprintResponse is what "/fingerprint" returns
+type FingerprintResponse struct {
+	Fingerprint string `json:"fingerprint"` //SHA256 of the server's certificate, or of its CA, hex encoded
+}
+
+//ServeFingerprint() is the http handler for the "/fingerprint" API endpoint
+//It returns the fingerprint of the server's certificate, so it can be compared with the one nodes pinned
+func ServeFingerprint(w http.ResponseWriter, r *http.Request) {
+	defer utils.TimeTrack(time.Now(), "api/ServeFingerprint()")
+	LogHttp(r)
+	errHandle := utils.NewHttpErrorHandle("api/ServeFingerprint()", w, r)
+	if validateRequestMethod(errHandle, "GET") == false {
+		return
+	}
+	if CertificateFingerprint == "" {
+		errHandle.Handle(fmt.Errorf("Server isn't using TLS"), http.StatusNotFound, utils.ErrorActionErr)
+		return
+	}
+	serial, _ := json.Marshal(&FingerprintResponse{Fingerprint: CertificateFingerprint})
+	w.Header().Set("Content-Type", "application/json")
+	setDefaultResponseHeaders(w)
+	io.WriteString(w, string(serial))
+}
+
 //ServeServerVer() is the http handler for the "/version" http API endpoint.
 //It writes the json encoded struct version.VersionInfo to the client
 func ServeServerVer(w http.ResponseWriter, r *http.Request) {
@@ -141,7 +501,8 @@ func ServeServerVer(w http.ResponseWriter, r *http.Request) {
 //If the requested file is a directory, it will be tarballed and the "Content-Type" http-header will be
 //set to "application/x-tar".
 //If the file is a normal file, it will be served with http.ServeContent(), with the Content-Type http-header
-//set by http.ServeContent()
+//set by http.ServeContent(). The ETag http-header is set to the file's checksum, so nodes can resume
+//interrupted transfers with the Range and If-Range http-headers
 func ServeSync(w http.ResponseWriter, r *http.Request) {
 	defer utils.TimeTrack(time.Now(), "api/ServeSync()")
 	errHandle := utils.NewHttpErrorHandle("api/ServeSync()", w, r)
@@ -164,6 +525,20 @@ func ServeSync(w http.ResponseWriter, r *http.Request) {
 	if grab == "" {
 		return
 	}
+	grab, err = utils.ConfinePath("./", grab)
+	if errHandle.Handle(err, http.StatusForbidden, utils.ErrorActionErr) == true {
+		return
+	}
+	if ignore.Ignored(grab) == true {
+		errHandle.Handle(fmt.Errorf("Path is excluded by the ignore rules"), http.StatusForbidden, utils.ErrorActionErr)
+		return
+	}
+	//Symbolic links aren't followed, their target is sent instead
+	if linkInfo, err := os.Lstat(grab); err == nil && linkInfo.Mode()&os.ModeSymlink != 0 {
+		serveSymlink(errHandle, w, grab)
+		nodelist.UpdateNodeStatus(uuid, true, true)
+		return
+	}
 	fd, err := os.Open(grab)
 	if errHandle.Handle(err, http.StatusInternalServerError, utils.ErrorActionErr) == true {
 		return
@@ -174,18 +549,287 @@ func ServeSync(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if info.IsDir() == true {
-		err := packing.PackDir(grab, w)
-		if errHandle.Handle(err, http.StatusInternalServerError, utils.ErrorActionErr) == true {
-			return
-		}
 		w.Header().Set("Content-Type", "application/x-tar")
+		setDefaultResponseHeaders(w)
+		err := packing.PackDir(grab, w)
+		//The tarball is streamed, so once it's started all we can do is log errors
+		utils.HandleError(err, utils.ErrorActionErr)
 		return
 	}
+	if cached := cache.GetFile(grab, nodeAlgorithm(uuid)); cached != nil && cached.Checksum != "" {
+		w.Header().Set("ETag", `"`+cached.Checksum+`"`)
+	}
 	setDefaultResponseHeaders(w)
 	http.ServeContent(w, r, grab, info.ModTime(), fd)
 	nodelist.UpdateNodeStatus(uuid, true, true)
 }
 
+//serveSymlink writes the target of the symbolic link at name as the response body
+func serveSymlink(errHandle *utils.HttpErrorHandler, w http.ResponseWriter, name string) {
+	link, err := os.Readlink(name)
+	if errHandle.Handle(err, http.StatusInternalServerError, utils.ErrorActionErr) == true {
+		return
+	}
+	if options.Config.SymlinkPolicy == options.SymlinkPolicySkip && utils.LinkEscapes(name, link) == true {
+		errHandle.Handle(fmt.Errorf("Symbolic link points outside of the tree"), http.StatusForbidden,
+			utils.ErrorActionErr)
+		return
+	}
+	w.Header().Set("Content-Type", "inode/symlink")
+	setDefaultResponseHeaders(w)
+	io.WriteString(w, link)
+}
+
+//verifyingReader hashes a file as http.ServeContent() reads it, and aborts the response if what
+//was read doesn't match the checksum it was served under. Only reads of the whole file from the
+//start can be verified, ranges are served as-is
+type verifyingReader struct {
+	file     *os.File
+	hash     hash.Hash
+	expected string
+	size     int64
+	offset   int64
+	verify   bool
+}
+
+func newVerifyingReader(file *os.File, size int64, algorithm string, expected string) *verifyingReader {
+	return &verifyingReader{file: file, hash: index.NewHash(algorithm), expected: expected, size: size, verify: true}
+}
+
+func (v *verifyingReader) Seek(offset int64, whence int) (int64, error) {
+	position, err := v.file.Seek(offset, whence)
+	v.offset = position
+	v.verify = (position == 0)
+	v.hash.Reset()
+	return position, err
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.file.Read(p)
+	if v.verify == false {
+		return n, err
+	}
+	v.hash.Write(p[:n])
+	v.offset += int64(n)
+	if v.offset >= v.size {
+		v.verify = false
+		if actual := hex.EncodeToString(v.hash.Sum(nil)); actual != v.expected {
+			//The status has already been sent, all we can do is cut the response short
+			//so the node doesn't take it for the complete file
+			log.Errorf("%s changed while it was being sent: expected %s got %s", v.file.Name(), v.expected, actual)
+			panic(http.ErrAbortHandler)
+		}
+	}
+	return n, err
+}
+
+//ServeBlob() is the http handler for the "/blob/<checksum>" API endpoint.
+//It serves the content of the file passed as the url parameter "grab", but only if it still has
+//the checksum in the url, computed with the hash algorithm chosen for the node. If the server's index
+//has a different checksum for the file, HTTP 410 Gone is returned, and if the file changed on disk since
+//it was indexed, HTTP 409 Conflict. The content is hashed as it's sent, and the response is cut short
+//if the file changes in the meantime, so a complete response always matches the checksum
+func ServeBlob(w http.ResponseWriter, r *http.Request) {
+	defer utils.TimeTrack(time.Now(), "api/ServeBlob()")
+	errHandle := utils.NewHttpErrorHandle("api/ServeBlob()", w, r)
+	LogHttp(r)
+	if validateRequestMethod(errHandle, "GET") == false {
+		return
+	}
+	uuid, err := GetQueryValue("uuid", w, r)
+	if errHandle.Handle(err, http.StatusInternalServerError, utils.ErrorActionErr) == true {
+		return
+	}
+	if nodelist.ValidateNode(uuid) == false {
+		errHandle.Handle(fmt.Errorf("Invalid node UUID"), http.StatusUnauthorized, utils.ErrorActionErr)
+		return
+	}
+	checksum := path.Base(r.URL.Path)
+	grab, err := GetQueryValue("grab", w, r)
+	if errHandle.Handle(err, http.StatusBadRequest, utils.ErrorActionErr) == true {
+		return
+	}
+	if grab == "" || checksum == "" || checksum == "blob" {
+		errHandle.Handle(fmt.Errorf("Must specify file and checksum"), http.StatusBadRequest, utils.ErrorActionErr)
+		return
+	}
+	grab, err = utils.ConfinePath("./", grab)
+	if errHandle.Handle(err, http.StatusForbidden, utils.ErrorActionErr) == true {
+		return
+	}
+	if ignore.Ignored(grab) == true {
+		errHandle.Handle(fmt.Errorf("Path is excluded by the ignore rules"), http.StatusForbidden, utils.ErrorActionErr)
+		return
+	}
+
+	algorithm := nodeAlgorithm(uuid)
+	cached := cache.GetFile(grab, algorithm)
+	if cached == nil || cached.IsDir == true || cached.Checksum != checksum {
+		errHandle.Handle(fmt.Errorf("%s no longer has checksum %s", grab, checksum), http.StatusGone, utils.ErrorActionWarn)
+		return
+	}
+	fd, err := os.Open(grab)
+	if errHandle.Handle(err, http.StatusInternalServerError, utils.ErrorActionErr) == true {
+		return
+	}
+	defer fd.Close()
+	info, err := fd.Stat()
+	if errHandle.Handle(err, http.StatusInternalServerError, utils.ErrorActionErr) == true {
+		return
+	}
+	if info.Mode().IsRegular() == false || info.Size() != cached.Size || info.ModTime().Equal(cached.ModTime) == false {
+		errHandle.Handle(fmt.Errorf("%s changed since it was indexed", grab), http.StatusConflict, utils.ErrorActionWarn)
+		return
+	}
+
+	//The content of a blob never changes, so it can be cached for as long as anyone likes
+	w.Header().Set("ETag", `"`+checksum+`"`)
+	w.Header().Set("Cache-Control", "public, max-age=31536000")
+	setDefaultResponseHeaders(w)
+	http.ServeContent(w, r, grab, info.ModTime(), newVerifyingReader(fd, info.Size(), algorithm, checksum))
+	nodelist.UpdateNodeStatus(uuid, true, true)
+}
+
+//ServeDelta() is the http handler for the "/delta" http API endpoint.
+//It takes the requested file name passed as a url parameter "grab" i.e "/delta?grab=file1", and
+//the delta.Signature of the node's copy of that file, encoded in json, as the request body.
+//
+//It writes a stream of json encoded delta.Instruction that rebuild the server's copy of the file
+//from the node's copy, so only the blocks that differ are transferred
+func ServeDelta(w http.ResponseWriter, r *http.Request) {
+	defer utils.TimeTrack(time.Now(), "api/ServeDelta()")
+	errHandle := utils.NewHttpErrorHandle("api/ServeDelta()", w, r)
+	LogHttp(r)
+	if validateRequestMethod(errHandle, "POST") == false {
+		return
+	}
+	uuid, err := GetQueryValue("uuid", w, r)
+	if errHandle.Handle(err, http.StatusInternalServerError, utils.ErrorActionErr) == true {
+		return
+	}
+	if nodelist.ValidateNode(uuid) == false {
+		errHandle.Handle(fmt.Errorf("Invalid node UUID"), http.StatusUnauthorized, utils.ErrorActionErr)
+		return
+	}
+	grab, err := GetQueryValue("grab", w, r)
+	if errHandle.Handle(err, http.StatusBadRequest, utils.ErrorActionErr) == true {
+		return
+	}
+	if grab == "" {
+		errHandle.Handle(fmt.Errorf("Must specify file"), http.StatusBadRequest, utils.ErrorActionErr)
+		return
+	}
+	grab, err = utils.ConfinePath("./", grab)
+	if errHandle.Handle(err, http.StatusForbidden, utils.ErrorActionErr) == true {
+		return
+	}
+	if ignore.Ignored(grab) == true {
+		errHandle.Handle(fmt.Errorf("Path is excluded by the ignore rules"), http.StatusForbidden, utils.ErrorActionErr)
+		return
+	}
+
+	serial, err := ioutil.ReadAll(r.Body)
+	if errHandle.Handle(err, http.StatusInternalServerError, utils.ErrorActionErr) {
+		return
+	}
+	var signature *delta.Signature
+	err = json.Unmarshal(serial, &signature)
+	if errHandle.Handle(err, http.StatusBadRequest, utils.ErrorActionErr) {
+		return
+	}
+	if signature == nil || signature.BlockSize < delta.MinBlockSize || signature.BlockSize > delta.MaxBlockSize {
+		errHandle.Handle(fmt.Errorf("Invalid block signature"), http.StatusBadRequest, utils.ErrorActionErr)
+		return
+	}
+
+	if linkInfo, err := os.Lstat(grab); err == nil && linkInfo.Mode().IsRegular() == false {
+		errHandle.Handle(fmt.Errorf("Not a regular file"), http.StatusBadRequest, utils.ErrorActionErr)
+		return
+	}
+	fd, err := os.Open(grab)
+	if errHandle.Handle(err, http.StatusInternalServerError, utils.ErrorActionErr) == true {
+		return
+	}
+	defer fd.Close()
+	info, err := fd.Stat()
+	if errHandle.Handle(err, http.StatusInternalServerError, utils.ErrorActionErr) == true {
+		return
+	}
+	if info.IsDir() == true {
+		errHandle.Handle(fmt.Errorf("Cannot compute delta of a directory"), http.StatusBadRequest, utils.ErrorActionErr)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	setDefaultResponseHeaders(w)
+	encoder := json.NewEncoder(w)
+	err = delta.ComputeDelta(signature, fd, func(instruction *delta.Instruction) error {
+		return encoder.Encode(instruction)
+	})
+	//The response has already started, so all we can do is log it
+	utils.HandleError(err, utils.ErrorActionErr)
+}
+
+//ServeBatch() is the http handler for the "/batch" API endpoint.
+//It takes a list of files as a json encoded array of strings in the request body, and writes a tarball
+//of them with the "Content-Type" http-header set to "application/x-tar", so nodes can fetch many small
+//files with a single request. Files that no longer exist, or aren't regular files, are left out
+func ServeBatch(w http.ResponseWriter, r *http.Request) {
+	defer utils.TimeTrack(time.Now(), "api/ServeBatch()")
+	errHandle := utils.NewHttpErrorHandle("api/ServeBatch()", w, r)
+	LogHttp(r)
+	if validateRequestMethod(errHandle, "POST") == false {
+		return
+	}
+	uuid, err := GetQueryValue("uuid", w, r)
+	if errHandle.Handle(err, http.StatusInternalServerError, utils.ErrorActionErr) == true {
+		return
+	}
+	if nodelist.ValidateNode(uuid) == false {
+		errHandle.Handle(fmt.Errorf("Invalid node UUID"), http.StatusUnauthorized, utils.ErrorActionErr)
+		return
+	}
+
+	serial, err := ioutil.ReadAll(r.Body)
+	if errHandle.Handle(err, http.StatusInternalServerError, utils.ErrorActionErr) {
+		return
+	}
+	var grab []string
+	err = json.Unmarshal(serial, &grab)
+	if errHandle.Handle(err, http.StatusBadRequest, utils.ErrorActionErr) {
+		return
+	}
+	if len(grab) == 0 {
+		errHandle.Handle(fmt.Errorf("Must specify files"), http.StatusBadRequest, utils.ErrorActionErr)
+		return
+	}
+	node := nodelist.GetNodeByUUID(uuid)
+	names := make([]string, 0, len(grab))
+	for _, name := range grab {
+		name, err = utils.ConfinePath("./", name)
+		if errHandle.Handle(err, http.StatusForbidden, utils.ErrorActionErr) == true {
+			return
+		}
+		if errHandle.Handle(checkSubtree(node, name), http.StatusForbidden, utils.ErrorActionErr) == true {
+			return
+		}
+		if ignore.Ignored(name) == true {
+			errHandle.Handle(fmt.Errorf("Path is excluded by the ignore rules"), http.StatusForbidden, utils.ErrorActionErr)
+			return
+		}
+		if info, err := os.Lstat(name); err == nil && info.Mode().IsRegular() == true {
+			names = append(names, name)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	setDefaultResponseHeaders(w)
+	err = packing.PackFiles(names, w)
+	//The tarball is streamed, so once it's started all we can do is log errors
+	utils.HandleError(err, utils.ErrorActionErr)
+	nodelist.UpdateNodeStatus(uuid, true, true)
+}
+
 //ListNodes() is the http handler for the "/nodes" API endpoint
 //It returns the CurrentNodes map encoded in json
 func ListNodes(w http.ResponseWriter, r *http.Request) {
@@ -223,9 +867,59 @@ func StartHeartBeatTracker() {
 	}
 }
 
+//nodeAlgorithm returns the hash algorithm chosen for the indexes sent to the node with uuid
+func nodeAlgorithm(uuid string) string {
+	if node := nodelist.GetNodeByUUID(uuid); node != nil && node.Meta != nil && node.Meta.Algorithm != "" {
+		return node.Meta.Algorithm
+	}
+	return index.DefaultAlgorithm
+}
+
+//chooseAlgorithm returns the first of the hash algorithms a node prefers that the server
+//indexes with. Nodes that don't send any predate the choice, and only use the default
+func chooseAlgorithm(preferred []string) (string, error) {
+	if len(preferred) == 0 {
+		return index.DefaultAlgorithm, nil
+	}
+	available := cache.Algorithms()
+	for _, algorithm := range preferred {
+		for _, indexed := range available {
+			if algorithm == indexed {
+				return algorithm, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("No hash algorithm in common, the server uses %v", available)
+}
+
+//useJoinToken uses the join token a new node identified with, which is required if options.Config.RequireJoinToken
+//is set. Returns an empty token if the node didn't send one. On error, the error is written to the client and
+//false is returned
+func useJoinToken(errHandle *utils.HttpErrorHandler, value string, target string) (*tokens.Token, bool) {
+	if value == "" && options.Config.RequireJoinToken == false {
+		return &tokens.Token{}, true
+	}
+	if value == "" {
+		errHandle.Handle(fmt.Errorf("A join token is required to enroll"), http.StatusUnauthorized, utils.ErrorActionErr)
+		return nil, false
+	}
+	token, err := tokens.Use(value, target)
+	if errHandle.Handle(err, http.StatusUnauthorized, utils.ErrorActionErr) == true {
+		return nil, false
+	}
+	log.Infof("Join token %s used %d of %d times", token.ID, token.Uses, token.MaxUses)
+	return token, true
+}
+
 //Identify() is the http handler for the "/identify" API endpoint
-//It takes a node UUID and node version as json encoded strings
-//The node is added to the CurrentNodes map, with the RFC850 timestamp
+//It takes a node UUID, node version and the hash algorithms the node supports as json encoded strings
+//The node is added to the CurrentNodes map, with the RFC850 timestamp, and the hash algorithm chosen
+//for its indexes is written back to it as a nodelist.IdentifyResponse encoded in json
+//New nodes, and nodes that enrolled before nodes were given secrets, get the secret to sign their
+//requests with in the response. Nodes that already have one have to sign the request with it. When join
+//tokens or approval are required, nodes that don't have to bring a join token, or are held as pending until
+//an admin approves them.
+//New nodes are held as pending if options.Config.RequireApproval is set, and rejected nodes are refused
 func Identify(w http.ResponseWriter, r *http.Request) {
 	defer utils.TimeTrack(time.Now(), "api/Identify()")
 	errHandle := utils.NewHttpErrorHandle("api/Identify()", w, r)
@@ -247,22 +941,91 @@ func Identify(w http.ResponseWriter, r *http.Request) {
 		errHandle.Handle(fmt.Errorf("Invalid or incomplete identify data"), http.StatusBadRequest, utils.ErrorActionErr)
 		return
 	}
+	//The join token is only needed to enroll, and mustn't end up in the node list
+	joinToken := metaData.JoinToken
+	metaData.JoinToken = ""
+	metaData.Algorithm, err = chooseAlgorithm(metaData.Algorithms)
+	if errHandle.Handle(err, http.StatusBadRequest, utils.ErrorActionErr) {
+		return
+	}
 
+	var secret string
+	var status string
 	//Handle to see if this node is already tracked
 	if nodelist.ValidateNode(metaData.UUID) == true {
 		node := nodelist.GetNodeByUUID(metaData.UUID)
-		//Node was offline, but has come back
+		if errHandle.Handle(checkIdentity(node, r), http.StatusUnauthorized, utils.ErrorActionErr) {
+			return
+		}
+		//Otherwise anyone who knows its UUID could take its place
+		if node.Secret != "" {
+			if r.Header.Get(auth.HeaderNode) != metaData.UUID {
+				errHandle.Handle(fmt.Errorf("Request is not signed"), http.StatusUnauthorized, utils.ErrorActionErr)
+				return
+			}
+			err = auth.Verify(r, serial, node.Secret, signatureMaxAge())
+			if errHandle.Handle(err, http.StatusUnauthorized, utils.ErrorActionErr) {
+				return
+			}
+		}
+		if node.ApprovalStatus() == nodelist.StatusRejected {
+			errHandle.Handle(fmt.Errorf("Node was rejected by the server's admin"), http.StatusForbidden,
+				utils.ErrorActionErr)
+			return
+		}
+		//The node enrolled before nodes were given secrets, or an admin reset its secret. When the server
+		//requires join tokens or approval, knowing its UUID isn't enough to be given one, it has to bring a
+		//join token, or wait for an admin to approve it. Otherwise it's given one, as a new node would be
+		if node.Secret == "" {
+			if joinToken != "" {
+				token, ok := useJoinToken(errHandle, joinToken, metaData.Target)
+				if ok == false {
+					return
+				}
+				node.JoinToken = token.ID
+				node.Subtree = token.Subtree
+				node.Labels = token.Labels
+			} else if options.Config.RequireJoinToken == true || options.Config.RequireApproval == true {
+				node.Status = nodelist.StatusPending
+				log.Warnf("Node (%s) enrolled again without a join token, it's pending approval", node.ShortUUID())
+			}
+			secret, err = auth.NewSecret()
+			if errHandle.Handle(err, http.StatusInternalServerError, utils.ErrorActionErr) {
+				return
+			}
+			node.Secret = secret
+			log.Infof("Node (%s) was given a secret", node.ShortUUID())
+		}
+		status = node.Status
+		//Node was offline, or was restarted before the server noticed
 		if node.IsOnline == false {
 			log.Infof("Node (%s) came back online", node.ShortUUID())
-			node.IsOnline = true
-			//Node already exists, error out
-		} else if node.IsOnline == true {
-			log.Warnf("Node (%s) attempted to identify again", node.ShortUUID())
-			errHandle.Handle(fmt.Errorf("Node already exists"), http.StatusConflict, utils.ErrorActionWarn)
-			return
 		}
+		node.IsOnline = true
+		node.LastOnline = time.Now().Format(time.RFC850)
+		//It may have been restarted with different hash algorithms
+		node.Meta = metaData
+		nodelist.WriteNodeList(options.Config.NodeListFile)
 	} else {
 		//Otherwise it's new, so add it to the list
+		identity := certs.Identity(r)
+		if options.Config.ClientCA != "" && identity == "" {
+			errHandle.Handle(fmt.Errorf("No verified certificate with a common name"), http.StatusUnauthorized,
+				utils.ErrorActionErr)
+			return
+		}
+		token, ok := useJoinToken(errHandle, joinToken, metaData.Target)
+		if ok == false {
+			return
+		}
+		secret, err = auth.NewSecret()
+		if errHandle.Handle(err, http.StatusInternalServerError, utils.ErrorActionErr) {
+			return
+		}
+		//New nodes aren't served anything until an admin approves them
+		if options.Config.RequireApproval == true {
+			status = nodelist.StatusPending
+		}
 		nodelist.AddNode(metaData.UUID,
 			&nodelist.Node{
 				Address:    r.RemoteAddr,
@@ -270,13 +1033,29 @@ func Identify(w http.ResponseWriter, r *http.Request) {
 				IsOnline:   true,
 				Synced:     false,
 				Meta:       metaData,
+				Secret:     secret,
+				Identity:   identity,
+				JoinToken:  token.ID,
+				Subtree:    token.Subtree,
+				Labels:     token.Labels,
+				Status:     status,
 			})
 		log.Printf("Create node:(Full UUID:[%s] Address:[%s] Version:%s])",
 			metaData.UUID, r.RemoteAddr, metaData.Version)
+		if status == nodelist.StatusPending {
+			log.Warnf("Node (%s) is pending approval", metaData.UUID)
+		}
 		nodelist.WriteNodeList(options.Config.NodeListFile)
 	}
+	serial, _ = json.Marshal(&nodelist.IdentifyResponse{
+		Algorithm:  metaData.Algorithm,
+		Algorithms: cache.Algorithms(),
+		Secret:     secret,
+		Status:     status,
+	})
+	w.Header().Set("Content-Type", "application/json")
 	setDefaultResponseHeaders(w)
-	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, string(serial))
 }
 
 //HeartBeat() is the http handler for the "/heartbeat" API endpoint
@@ -303,23 +1082,57 @@ func HeartBeat(w http.ResponseWriter, r *http.Request) {
 		errHandle.Handle(fmt.Errorf("Invalid or incomplete heartbeat data"), http.StatusBadRequest, utils.ErrorActionErr)
 		return
 	}
-	if nodelist.ValidateNode(heartbeat.UUID) == false {
+	node := nodelist.GetNodeByUUID(heartbeat.UUID)
+	if node == nil {
 		errHandle.Handle(fmt.Errorf("Invalid node UUID"), http.StatusUnauthorized, utils.ErrorActionErr)
 		return
 	}
+	if errHandle.Handle(checkIdentity(node, r), http.StatusUnauthorized, utils.ErrorActionErr) {
+		return
+	}
+	//AuthHandler() checked the signature, but the heartbeat names the node in its body
+	if r.Header.Get(auth.HeaderNode) != heartbeat.UUID && signatureRequired(node) == true {
+		errHandle.Handle(fmt.Errorf("Heartbeat signed by another node"), http.StatusUnauthorized, utils.ErrorActionErr)
+		return
+	}
+	//Pending nodes keep sending heartbeats while they wait, rejected ones are told to stop
+	if node.ApprovalStatus() == nodelist.StatusRejected {
+		errHandle.Handle(fmt.Errorf("Node was rejected by the server's admin"), http.StatusForbidden, utils.ErrorActionErr)
+		return
+	}
 	synced, _ := strconv.ParseBool(heartbeat.Synced)
 	nodelist.UpdateNodeStatus(heartbeat.UUID, true, synced)
 	setDefaultResponseHeaders(w)
 	w.WriteHeader(http.StatusOK)
 }
 
+//SetupRoutes registers the API endpoints. Everything but "/version", "/fingerprint", "/identify" and the admin
+//endpoints is only served to registered nodes, through AuthHandler(), and everything but "/heartbeat"
+//only to approved ones, through ApprovedHandler(). The admin endpoints are only registered
+//if there's an admin token to authorize admins with
 func SetupRoutes() {
-	http.HandleFunc("/v"+version.GetMajor()+"/index", GzipHandler(ServeIndex))
-	http.HandleFunc("/v"+version.GetMajor()+"/sync", GzipHandler(ServeSync))
+	setupBandwidthLimits()
+	http.HandleFunc("/v"+version.GetMajor()+"/index", AuthHandler(ApprovedHandler(GzipHandler(ServeIndex))))
+	http.HandleFunc("/v"+version.GetMajor()+"/changes", AuthHandler(ApprovedHandler(GzipHandler(ServeChanges))))
+	http.HandleFunc("/v"+version.GetMajor()+"/wait", AuthHandler(ApprovedHandler(GzipHandler(ServeWait))))
+	http.HandleFunc("/v"+version.GetMajor()+"/sync", AuthHandler(ApprovedHandler(ThrottleHandler(GzipHandler(ServeSync)))))
+	http.HandleFunc("/v"+version.GetMajor()+"/delta", AuthHandler(ApprovedHandler(ThrottleHandler(GzipHandler(ServeDelta)))))
+	http.HandleFunc("/v"+version.GetMajor()+"/blob/", AuthHandler(ApprovedHandler(ThrottleHandler(GzipHandler(ServeBlob)))))
+	http.HandleFunc("/v"+version.GetMajor()+"/batch", AuthHandler(ApprovedHandler(ThrottleHandler(GzipHandler(ServeBatch)))))
 	http.HandleFunc("/v"+version.GetMajor()+"/identify", GzipHandler(Identify))
 	if options.Config.NodeEndpoint == true {
-		http.HandleFunc("/v"+version.GetMajor()+"/nodes", GzipHandler(ListNodes))
+		http.HandleFunc("/v"+version.GetMajor()+"/nodes", AuthHandler(ApprovedHandler(GzipHandler(ListNodes))))
 	}
-	http.HandleFunc("/v"+version.GetMajor()+"/heartbeat", GzipHandler(HeartBeat))
+	http.HandleFunc("/v"+version.GetMajor()+"/heartbeat", AuthHandler(GzipHandler(HeartBeat)))
 	http.HandleFunc("/version", GzipHandler(ServeServerVer))
+	http.HandleFunc("/fingerprint", GzipHandler(ServeFingerprint))
+	if options.Config.AdminToken != "" {
+		http.HandleFunc("/v"+version.GetMajor()+"/admin/tokens", AdminHandler(GzipHandler(AdminListTokens)))
+		http.HandleFunc("/v"+version.GetMajor()+"/admin/mint", AdminHandler(GzipHandler(AdminMintToken)))
+		http.HandleFunc("/v"+version.GetMajor()+"/admin/revoke", AdminHandler(GzipHandler(AdminRevokeToken)))
+		http.HandleFunc("/v"+version.GetMajor()+"/admin/nodes", AdminHandler(GzipHandler(AdminListNodes)))
+		http.HandleFunc("/v"+version.GetMajor()+"/admin/approve", AdminHandler(GzipHandler(AdminApproveNode)))
+		http.HandleFunc("/v"+version.GetMajor()+"/admin/reject", AdminHandler(GzipHandler(AdminRejectNode)))
+		http.HandleFunc("/v"+version.GetMajor()+"/admin/reset", AdminHandler(GzipHandler(AdminResetNode)))
+	}
 }
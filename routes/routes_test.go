@@ -1,17 +1,28 @@
 package routes_test
 
 import (
+	"archive/tar"
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"github.com/tywkeene/autobd/auth"
+	"github.com/tywkeene/autobd/cache"
+	"github.com/tywkeene/autobd/delta"
 	"github.com/tywkeene/autobd/index"
 	"github.com/tywkeene/autobd/node"
 	"github.com/tywkeene/autobd/nodelist"
 	"github.com/tywkeene/autobd/options"
 	"github.com/tywkeene/autobd/routes"
+	"github.com/tywkeene/autobd/tokens"
 	"github.com/tywkeene/autobd/utils"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
 	"strconv"
 	"testing"
 	"time"
@@ -49,6 +60,24 @@ func TestGzip(t *testing.T) {
 	}
 }
 
+//Ensure a streamed response that's gzip'd is sent as it's flushed, rather than when the handler returns
+func TestGzipFlush(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	handler := routes.GzipHandler(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "streamed")
+		w.(http.Flusher).Flush()
+		if recorder.Flushed == false || recorder.Body.Len() == 0 {
+			t.Error("Response wasn't flushed")
+		}
+	})
+	req, err := http.NewRequest("GET", "/sync", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept-Encoding", "application/x-gzip")
+	handler.ServeHTTP(recorder, req)
+}
+
 //Ensure the /index endpoint fails if we specify a directory to index but no UUID
 func TestServeIndexNoUUID(t *testing.T) {
 	req, err := http.NewRequest("GET", "/index?dir=/", nil)
@@ -254,6 +283,159 @@ func TestServeSync(t *testing.T) {
 	}
 }
 
+//Ensure paths outside of the served tree can't be synced
+func TestServeSyncOutsideRoot(t *testing.T) {
+	handler := http.HandlerFunc(routes.ServeSync)
+	nodelist.AddNode("test", &nodelist.Node{
+		Address:    "0.0.0.0",
+		LastOnline: time.Now().Format(time.RFC850),
+		IsOnline:   true,
+		Meta: &nodelist.NodeMetadata{
+			UUID:    "test",
+			Version: "0.0.0",
+		},
+	})
+	for _, grab := range []string{"../routes/routes.go", "/etc/passwd", "a/../../routes.go"} {
+		recorder := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/sync?grab="+url.QueryEscape(grab)+"&uuid=test", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler.ServeHTTP(recorder, req)
+		if recorder.Code != http.StatusForbidden {
+			t.Errorf("Expected %d syncing %s, got %d", http.StatusForbidden, grab, recorder.Code)
+		}
+	}
+}
+
+//Ensure a batch only contains the requested files that exist, and can't reach outside of the served tree
+func TestServeBatch(t *testing.T) {
+	handler := http.HandlerFunc(routes.ServeBatch)
+	nodelist.AddNode("test", &nodelist.Node{
+		Address:    "0.0.0.0",
+		LastOnline: time.Now().Format(time.RFC850),
+		IsOnline:   true,
+		Meta: &nodelist.NodeMetadata{
+			UUID:    "test",
+			Version: "0.0.0",
+		},
+	})
+
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "/batch?uuid=test", bytes.NewBufferString(`["routes.go", "missing"]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", recorder.Code, http.StatusOK)
+	}
+	tr := tar.NewReader(recorder.Body)
+	names := make([]string, 0)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, header.Name)
+	}
+	if len(names) != 1 || names[0] != "routes.go" {
+		t.Errorf("Expected a tarball of routes.go, got %v", names)
+	}
+
+	recorder = httptest.NewRecorder()
+	req, err = http.NewRequest("POST", "/batch?uuid=test", bytes.NewBufferString(`["routes.go", "../routes/routes.go"]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Expected %d for a file outside of the tree, got %d", http.StatusForbidden, recorder.Code)
+	}
+}
+
+//Ensure files are only served under the checksum they currently have
+func TestServeBlob(t *testing.T) {
+	handler := http.HandlerFunc(routes.ServeBlob)
+	nodelist.AddNode("test", &nodelist.Node{
+		Address:    "0.0.0.0",
+		LastOnline: time.Now().Format(time.RFC850),
+		IsOnline:   true,
+		Meta: &nodelist.NodeMetadata{
+			UUID:    "test",
+			Version: "0.0.0",
+		},
+	})
+	if err := cache.Initialize("./", []string{index.DefaultAlgorithm}); err != nil {
+		t.Fatal(err)
+	}
+	checksum := index.GetChecksum("routes.go")
+
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/blob/"+checksum+"?grab=routes.go&uuid=test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", recorder.Code, http.StatusOK)
+	}
+	expected, _ := ioutil.ReadFile("routes.go")
+	if bytes.Equal(recorder.Body.Bytes(), expected) == false {
+		t.Error("Served content doesn't match the file")
+	}
+
+	recorder = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/blob/"+index.GetChecksum("routes_test.go")+"?grab=routes.go&uuid=test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusGone {
+		t.Errorf("Expected %d for an outdated checksum, got %d", http.StatusGone, recorder.Code)
+	}
+}
+
+//Ensure a node waiting for changes is told nothing changed once the timeout passes
+func TestServeWait(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	handler := http.HandlerFunc(routes.ServeWait)
+	nodelist.AddNode("test", &nodelist.Node{
+		Address:    "0.0.0.0",
+		LastOnline: time.Now().Format(time.RFC850),
+		IsOnline:   true,
+		Meta: &nodelist.NodeMetadata{
+			UUID:    "test",
+			Version: "0.0.0",
+		},
+	})
+	options.Config.LongPollTimeout = "50ms"
+
+	_, latest, _ := cache.Changes(0)
+	req, err := http.NewRequest("GET", "/wait?dir=./&uuid=test&journal="+cache.JournalID()+
+		"&since="+strconv.FormatUint(latest, 10), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", recorder.Code, http.StatusOK)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Returned after %s, before the timeout", elapsed)
+	}
+	var changeSet *index.ChangeSet
+	if err := json.Unmarshal(recorder.Body.Bytes(), &changeSet); err != nil {
+		t.Fatal(err)
+	}
+	if len(changeSet.Changes) != 0 || changeSet.Index != nil || changeSet.Sequence != latest {
+		t.Errorf("Expected no changes, got %v", changeSet)
+	}
+}
+
 //Ensure we get a consistent list of nodes
 func TestListNodes(t *testing.T) {
 	recorder := httptest.NewRecorder()
@@ -358,6 +540,310 @@ func TestIdentify(t *testing.T) {
 	}
 }
 
+//Ensure only requests signed with the node's secret get through
+func TestAuthHandler(t *testing.T) {
+	options.Config.SignatureMaxAge = "1m"
+	secret, err := auth.NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodelist.AddNode("signed", &nodelist.Node{
+		Address:    "0.0.0.0",
+		LastOnline: time.Now().Format(time.RFC850),
+		IsOnline:   true,
+		Meta: &nodelist.NodeMetadata{
+			UUID:    "signed",
+			Version: "0.0.0",
+		},
+		Secret: secret,
+	})
+	handler := http.HandlerFunc(routes.AuthHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	other, _ := auth.NewSecret()
+
+	var table = []struct {
+		Name   string
+		Query  string
+		Secret string
+		Status int
+	}{
+		{"signed", "uuid=signed", secret, http.StatusOK},
+		{"unsigned", "uuid=signed", "", http.StatusUnauthorized},
+		{"other secret", "uuid=signed", other, http.StatusUnauthorized},
+		{"other node", "uuid=test", secret, http.StatusUnauthorized},
+	}
+	for _, test := range table {
+		req, err := http.NewRequest("GET", "/index?dir=/&"+test.Query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.Secret != "" {
+			if err := auth.Sign(req, "signed", test.Secret); err != nil {
+				t.Fatal(err)
+			}
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if recorder.Code != test.Status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", test.Name, recorder.Code, test.Status)
+		}
+	}
+}
+
+//Ensure nodes have to present the certificate they're bound to when the server requires one
+func TestAuthHandlerCertificate(t *testing.T) {
+	options.Config.ClientCA = "ca.pem"
+	defer func() { options.Config.ClientCA = "" }()
+	nodelist.AddNode("certified", &nodelist.Node{
+		Address:    "0.0.0.0",
+		LastOnline: time.Now().Format(time.RFC850),
+		IsOnline:   true,
+		Meta: &nodelist.NodeMetadata{
+			UUID:    "certified",
+			Version: "0.0.0",
+		},
+		Identity: "node0.example.com",
+	})
+	handler := http.HandlerFunc(routes.AuthHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	var table = []struct {
+		Identity string
+		Status   int
+	}{
+		{"node0.example.com", http.StatusOK},
+		{"node1.example.com", http.StatusUnauthorized},
+		{"", http.StatusUnauthorized},
+	}
+	for _, test := range table {
+		req, err := http.NewRequest("GET", "/index?dir=/&uuid=certified", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.Identity != "" {
+			certificate := &x509.Certificate{Subject: pkix.Name{CommonName: test.Identity}}
+			req.TLS = &tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{certificate},
+				VerifiedChains:   [][]*x509.Certificate{{certificate}},
+			}
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if recorder.Code != test.Status {
+			t.Errorf("%q: handler returned wrong status code: got %v want %v", test.Identity, recorder.Code, test.Status)
+		}
+	}
+}
+
+//Ensure new nodes can only enroll with a join token when one is required, and the node records it
+func TestIdentifyJoinToken(t *testing.T) {
+	options.Config.RequireJoinToken = true
+	defer func() { options.Config.RequireJoinToken = false }()
+	minted, err := tokens.Mint(time.Hour, 1, "", []string{"eu"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	identify := func(uuid string, token string) int {
+		serial, _ := json.Marshal(&nodelist.NodeMetadata{Version: "0.0.0", UUID: uuid, Target: "./", JoinToken: token})
+		req, err := http.NewRequest("POST", "/identify", bytes.NewBuffer(serial))
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder := httptest.NewRecorder()
+		http.HandlerFunc(routes.Identify).ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	if status := identify("joining0", ""); status != http.StatusUnauthorized {
+		t.Errorf("Node without a token: got %v want %v", status, http.StatusUnauthorized)
+	}
+	if status := identify("joining0", minted.Value); status != http.StatusOK {
+		t.Fatalf("Node with a token: got %v want %v", status, http.StatusOK)
+	}
+	node := nodelist.GetNodeByUUID("joining0")
+	if node.JoinToken != minted.ID || len(node.Labels) != 1 || node.Meta.JoinToken != "" {
+		t.Errorf("Token not recorded, or stored in the node list: %+v %+v", node, node.Meta)
+	}
+	if status := identify("joining1", minted.Value); status != http.StatusUnauthorized {
+		t.Errorf("Node with a used up token: got %v want %v", status, http.StatusUnauthorized)
+	}
+}
+
+//Ensure new nodes are held until an admin approves them, and the decision is kept in the node list
+func TestApproval(t *testing.T) {
+	listFile, err := ioutil.TempFile("", "autobd-nodes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listFile.Close()
+	defer os.Remove(listFile.Name())
+	options.Config.NodeListFile = listFile.Name()
+	options.Config.RequireApproval = true
+	defer func() {
+		options.Config.NodeListFile = ""
+		options.Config.RequireApproval = false
+	}()
+
+	serial, _ := json.Marshal(&nodelist.NodeMetadata{Version: "0.0.0", UUID: "pending0", Target: "./"})
+	req, err := http.NewRequest("POST", "/identify", bytes.NewBuffer(serial))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	http.HandlerFunc(routes.Identify).ServeHTTP(recorder, req)
+	var response *nodelist.IdentifyResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Status != nodelist.StatusPending {
+		t.Errorf("New node not pending: %+v", response)
+	}
+
+	fetch := func() int {
+		req, err := http.NewRequest("GET", "/index?dir=./&uuid=pending0", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder := httptest.NewRecorder()
+		routes.ApprovedHandler(func(w http.ResponseWriter, r *http.Request) {}).ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+	decide := func(endpoint string, handler http.HandlerFunc) {
+		req, err := http.NewRequest("POST", endpoint+"?uuid=pending0", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("Decision failed: got %v want %v", recorder.Code, http.StatusOK)
+		}
+	}
+
+	if status := fetch(); status != http.StatusForbidden {
+		t.Errorf("Pending node: got %v want %v", status, http.StatusForbidden)
+	}
+	decide("/admin/approve", routes.AdminApproveNode)
+	if status := fetch(); status != http.StatusOK {
+		t.Errorf("Approved node: got %v want %v", status, http.StatusOK)
+	}
+	decide("/admin/reject", routes.AdminRejectNode)
+	if status := fetch(); status != http.StatusForbidden {
+		t.Errorf("Rejected node: got %v want %v", status, http.StatusForbidden)
+	}
+	saved, err := ioutil.ReadFile(listFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(saved, []byte(`"status": "rejected"`)) == false {
+		t.Errorf("Decision not written to the node list: %s", saved)
+	}
+}
+
+//Ensure a registered node without a secret isn't given one for knowing its UUID when approval is required,
+//and that a node whose secret was reset can enroll again with a join token
+func TestIdentifyReenroll(t *testing.T) {
+	listFile, err := ioutil.TempFile("", "autobd-nodes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listFile.Close()
+	defer os.Remove(listFile.Name())
+	options.Config.NodeListFile = listFile.Name()
+	options.Config.RequireApproval = true
+	defer func() {
+		options.Config.NodeListFile = ""
+		options.Config.RequireApproval = false
+	}()
+	uuid := "6f1c2b7e-0d3a-4e59-9b8c-1a2d3e4f5a6b"
+	//The server still thinks the node is online, as it does when a node is restarted quickly
+	nodelist.AddNode(uuid, &nodelist.Node{
+		Address:    "0.0.0.0",
+		LastOnline: time.Now().Format(time.RFC850),
+		IsOnline:   true,
+		Meta:       &nodelist.NodeMetadata{Version: "0.0.0", UUID: uuid, Target: "./"},
+	})
+	identify := func(token string) (int, *nodelist.IdentifyResponse) {
+		serial, _ := json.Marshal(&nodelist.NodeMetadata{Version: "0.0.0", UUID: uuid, Target: "./", JoinToken: token})
+		req, err := http.NewRequest("POST", "/identify", bytes.NewBuffer(serial))
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder := httptest.NewRecorder()
+		http.HandlerFunc(routes.Identify).ServeHTTP(recorder, req)
+		var response *nodelist.IdentifyResponse
+		json.Unmarshal(recorder.Body.Bytes(), &response)
+		return recorder.Code, response
+	}
+	admin := func(endpoint string, handler http.HandlerFunc) {
+		req, err := http.NewRequest("POST", endpoint+"?uuid="+uuid, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("%s failed: got %v want %v", endpoint, recorder.Code, http.StatusOK)
+		}
+	}
+
+	status, response := identify("")
+	if status != http.StatusOK || response.Secret == "" || response.Status != nodelist.StatusPending {
+		t.Fatalf("Node without a token: got %v %+v, want a secret and to be pending", status, response)
+	}
+	if status, _ := identify(""); status != http.StatusUnauthorized {
+		t.Errorf("Unsigned request for a node with a secret: got %v want %v", status, http.StatusUnauthorized)
+	}
+	admin("/admin/approve", routes.AdminApproveNode)
+	admin("/admin/reset", routes.AdminResetNode)
+	if nodelist.GetNodeByUUID(uuid).Secret != "" {
+		t.Fatal("Secret wasn't reset")
+	}
+
+	minted, err := tokens.Mint(time.Hour, 1, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, response = identify(minted.Value)
+	if status != http.StatusOK || response.Secret == "" || response.Status != nodelist.StatusApproved {
+		t.Fatalf("Node with a token: got %v %+v, want a secret and to stay approved", status, response)
+	}
+	if nodelist.GetNodeByUUID(uuid).JoinToken != minted.ID {
+		t.Error("Token the node enrolled again with wasn't recorded")
+	}
+}
+
+//Ensure a node that enrolled before nodes were given secrets is given one when it identifies again, and stays
+//approved, when the server requires neither join tokens nor approval
+func TestIdentifyLegacy(t *testing.T) {
+	uuid := "0b9e7c4d-5a1f-4c2e-8d3b-7f6a5e4d3c2b"
+	nodelist.AddNode(uuid, &nodelist.Node{
+		Address:    "0.0.0.0",
+		LastOnline: time.Now().Format(time.RFC850),
+		IsOnline:   true,
+		Meta:       &nodelist.NodeMetadata{Version: "0.0.0", UUID: uuid, Target: "./"},
+	})
+	serial, _ := json.Marshal(&nodelist.NodeMetadata{Version: "0.0.0", UUID: uuid, Target: "./"})
+	req, err := http.NewRequest("POST", "/identify", bytes.NewBuffer(serial))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	http.HandlerFunc(routes.Identify).ServeHTTP(recorder, req)
+	var response *nodelist.IdentifyResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if recorder.Code != http.StatusOK || response.Secret == "" {
+		t.Fatalf("Legacy node: got %v %+v, want a secret", recorder.Code, response)
+	}
+	if node := nodelist.GetNodeByUUID(uuid); node.Approved() == false || node.Secret != response.Secret {
+		t.Errorf("Legacy node not approved, or its secret not kept: %+v", node)
+	}
+}
+
 //Ensure the server properly handles heartbeats from a node
 func TestHeartBeat(t *testing.T) {
 	recorder := httptest.NewRecorder()
@@ -397,3 +883,52 @@ func TestHeartBeat(t *testing.T) {
 		t.Errorf("Node was not updated")
 	}
 }
+
+//Ensure the delta we get for a file rebuilds it from the node's copy
+func TestServeDelta(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	handler := http.HandlerFunc(routes.ServeDelta)
+
+	nodelist.AddNode("test", &nodelist.Node{
+		Address:    "0.0.0.0",
+		LastOnline: time.Now().Format(time.RFC850),
+		IsOnline:   true,
+		Synced:     false,
+		Meta: &nodelist.NodeMetadata{
+			UUID:    "test",
+			Version: "0.0.0",
+		},
+	})
+
+	expected, err := ioutil.ReadFile("routes.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Pretend the node has an outdated copy of the file
+	old := expected[:len(expected)/2]
+	signature, err := delta.GenerateSignature(bytes.NewReader(old), delta.MinBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := json.Marshal(&signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("POST", "/delta?grab=routes.go&uuid=test", bytes.NewBuffer(serial))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.ServeHTTP(recorder, req)
+
+	if status := recorder.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	var rebuilt bytes.Buffer
+	if err := delta.ApplyDelta(bytes.NewReader(old), delta.MinBlockSize, recorder.Body, &rebuilt); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(rebuilt.Bytes(), expected) == false {
+		t.Error("Delta did not rebuild the file")
+	}
+}
@@ -1,30 +1,123 @@
 package server
 
 import (
+	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/tywkeene/autobd/cache"
+	"github.com/tywkeene/autobd/certs"
+	"github.com/tywkeene/autobd/index"
 	"github.com/tywkeene/autobd/nodelist"
 	"github.com/tywkeene/autobd/options"
 	"github.com/tywkeene/autobd/routes"
+	"github.com/tywkeene/autobd/tokens"
 	"github.com/tywkeene/autobd/utils"
 	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
+//tlsDirectory returns where the generated certificate authority and certificate are kept: the configured
+//directory, or .autobd-tls in the home directory. Refuses a directory inside of the served root, which is
+//the working directory, since the CA's key would be served along with everything else
+func tlsDirectory() (string, error) {
+	dir := options.Config.TLSDirectory
+	if dir == "" {
+		home := os.Getenv("HOME")
+		if home == "" {
+			return "", fmt.Errorf("No tls_directory set, and no home directory to keep the certificates in")
+		}
+		dir = path.Join(home, ".autobd-tls")
+	}
+	root, err := filepath.EvalSymlinks(".")
+	if err != nil {
+		return "", err
+	}
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		abs = resolved
+	}
+	relative, err := filepath.Rel(root, abs)
+	if err == nil && relative != ".." && strings.HasPrefix(relative, "../") == false {
+		return "", fmt.Errorf("tls_directory (%s) is inside of the served root (%s), the CA's key would be served",
+			dir, root)
+	}
+	return dir, nil
+}
+
+//generateCertificate generates a certificate authority and a certificate signed by it in
+//options.Config.TLSDirectory, the first time the server runs without a certificate configured
+func generateCertificate() {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if hostname, err := os.Hostname(); err == nil {
+		hosts = append([]string{hostname}, hosts...)
+	}
+	hosts = append(hosts, options.Config.TLSHosts...)
+	cert, key, generated, err := certs.Generate(options.Config.TLSDirectory, hosts)
+	utils.HandlePanic(err)
+	if generated == true {
+		log.Infof("Generated a certificate authority and certificate for %v in (%s)", hosts, options.Config.TLSDirectory)
+	}
+	options.Config.Cert = cert
+	options.Config.Key = key
+}
+
 func Launch() {
 	if err := nodelist.ReadNodeList(options.Config.NodeListFile); err != nil {
 		utils.HandleError(err, utils.ErrorActionWarn)
 		nodelist.InitializeNodeList()
 	}
-	err := cache.Initialize("./")
+	if options.Config.JoinTokensFile != "" {
+		err := tokens.Load(options.Config.JoinTokensFile)
+		utils.HandleError(err, utils.ErrorActionErr)
+	}
+	if options.Config.RequireApproval == true && options.Config.AdminToken == "" {
+		log.Warn("New nodes are held for approval, but there's no admin token to approve them with")
+	}
+	if options.Config.Ssl == true && options.Config.Cert == "" && options.Config.Key == "" {
+		dir, err := tlsDirectory()
+		utils.HandlePanic(err)
+		options.Config.TLSDirectory = dir
+	}
+	if options.Config.IndexStateFile != "" {
+		err := index.UseState(options.Config.IndexStateFile)
+		utils.HandleError(err, utils.ErrorActionWarn)
+	}
+	err := cache.Initialize("./", options.Config.HashAlgorithms)
 	utils.HandlePanic(err)
+	rescanInterval, err := time.ParseDuration(options.Config.CacheRescanInterval)
+	utils.HandlePanic(err)
+	cache.Watch("./", options.Config.CacheWatch, rescanInterval)
 
+	if options.Config.Ssl == true && options.Config.Cert == "" && options.Config.Key == "" {
+		generateCertificate()
+	}
 	routes.SetupRoutes()
 	go routes.StartHeartBeatTracker()
 
 	log.Printf("Serving '%s' on port %s", options.Config.Root, options.Config.ApiPort)
 	if options.Config.Ssl == true {
 		log.Infof("Using certificate (%s) and key (%s) for SSL\n", options.Config.Cert, options.Config.Key)
-		log.Panic(http.ListenAndServeTLS(":"+options.Config.ApiPort, options.Config.Cert, options.Config.Key, nil))
+		fingerprint, err := certs.FileFingerprint(options.Config.Cert)
+		utils.HandlePanic(err)
+		log.Infof("Certificate fingerprint nodes pin (SHA256): %s", fingerprint)
+		routes.CertificateFingerprint = fingerprint
+		tlsConfig, err := certs.ServerConfig(options.Config.ClientCA)
+		utils.HandlePanic(err)
+		if tlsConfig != nil {
+			log.Infof("Requiring node certificates signed by (%s)", options.Config.ClientCA)
+		}
+		server := &http.Server{Addr: ":" + options.Config.ApiPort, TLSConfig: tlsConfig}
+		log.Panic(server.ListenAndServeTLS(options.Config.Cert, options.Config.Key))
 	} else {
 		log.Panic(http.ListenAndServe(":"+options.Config.ApiPort, nil))
 	}
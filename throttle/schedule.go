@@ -0,0 +1,142 @@
+package throttle
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+//scheduleRule is a rate that applies on some days of the week, between two times of the day
+type scheduleRule struct {
+	days  [7]bool
+	start int //Minutes since midnight
+	end   int //Minutes since midnight, before start if the rule spans midnight
+	rate  int64
+}
+
+func (rule *scheduleRule) matches(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if rule.start == rule.end {
+		return rule.days[day]
+	}
+	if rule.start < rule.end {
+		return rule.days[day] && minute >= rule.start && minute < rule.end
+	}
+	//The rule spans midnight, so the early morning belongs to the day before
+	if minute >= rule.start {
+		return rule.days[day]
+	}
+	return minute < rule.end && rule.days[(day+6)%7]
+}
+
+//Schedule is a list of rates that apply at different times of the week, like
+//"mon-fri 09:00-17:00 10MB/s" during business hours, and "unlimited" at any other time
+type Schedule struct {
+	rules []*scheduleRule
+}
+
+func parseDays(value string) ([7]bool, error) {
+	var days [7]bool
+	for _, part := range strings.Split(value, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		first, ok := weekdays[bounds[0]]
+		if ok == false {
+			return days, fmt.Errorf("Invalid day '%s'", bounds[0])
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, ok = weekdays[bounds[1]]; ok == false {
+				return days, fmt.Errorf("Invalid day '%s'", bounds[1])
+			}
+		}
+		for day := first; ; day = (day + 1) % 7 {
+			days[day] = true
+			if day == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+func parseTimeOfDay(value string) (int, error) {
+	parsed, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid time of day '%s'", value)
+	}
+	return parsed.Hour()*60 + parsed.Minute(), nil
+}
+
+//parseRule parses a single rule of a schedule: "[days] [HH:MM-HH:MM] rate"
+func parseRule(value string) (*scheduleRule, error) {
+	fields := strings.Fields(strings.ToLower(value))
+	if len(fields) == 0 || len(fields) > 3 {
+		return nil, fmt.Errorf("Invalid schedule '%s'", value)
+	}
+	rule := &scheduleRule{days: [7]bool{true, true, true, true, true, true, true}}
+	var err error
+	if fields[len(fields)-1] != "unlimited" {
+		if rule.rate, err = ParseRate(fields[len(fields)-1]); err != nil {
+			return nil, err
+		}
+	}
+	for _, field := range fields[:len(fields)-1] {
+		if strings.Contains(field, ":") == false {
+			if rule.days, err = parseDays(field); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		bounds := strings.SplitN(field, "-", 2)
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("Invalid time range '%s'", field)
+		}
+		if rule.start, err = parseTimeOfDay(bounds[0]); err != nil {
+			return nil, err
+		}
+		if rule.end, err = parseTimeOfDay(bounds[1]); err != nil {
+			return nil, err
+		}
+	}
+	return rule, nil
+}
+
+//ParseSchedule parses a schedule made of rules like "mon-fri 09:00-17:00 10MB/s". Each rule has
+//optional days of the week ("mon", "sat,sun", "mon-fri"), an optional time range, which may span
+//midnight, and a rate as understood by ParseRate(), or "unlimited". The first rule that matches the
+//current time applies, and no limit applies if none match. Returns nil if rules is empty
+func ParseSchedule(rules []string) (*Schedule, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	schedule := &Schedule{rules: make([]*scheduleRule, 0, len(rules))}
+	for _, value := range rules {
+		rule, err := parseRule(value)
+		if err != nil {
+			return nil, err
+		}
+		schedule.rules = append(schedule.rules, rule)
+	}
+	return schedule, nil
+}
+
+//RateAt returns the rate in bytes per second that applies at t, or 0 for no limit
+func (s *Schedule) RateAt(t time.Time) int64 {
+	for _, rule := range s.rules {
+		if rule.matches(t) == true {
+			return rule.rate
+		}
+	}
+	return 0
+}
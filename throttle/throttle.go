@@ -0,0 +1,144 @@
+//Package throttle limits the rate of I/O with a token bucket that can be shared between
+//any number of readers, so they stay under the limit together
+package throttle
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Limiter hands out a limited number of bytes per second. Readers that go over the limit
+//are put to sleep until they're back under it
+type Limiter struct {
+	rate     float64 //Bytes per second, 0 for no limit
+	tokens   float64 //Bytes that can be read right now, negative when readers are over the limit
+	last     time.Time
+	schedule *Schedule //If set, rate follows it
+	checked  time.Time //When rate was last set from schedule
+	lock     sync.Mutex
+}
+
+//NewLimiter returns a Limiter allowing rate bytes per second, with bursts of up to one
+//second worth of bytes
+func NewLimiter(rate int64) *Limiter {
+	return &Limiter{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+//NewScheduledLimiter returns a Limiter whose rate changes over time according to schedule.
+//If schedule is nil, nil is returned, which Reader() and Writer() take as no limit
+func NewScheduledLimiter(schedule *Schedule) *Limiter {
+	if schedule == nil {
+		return nil
+	}
+	now := time.Now()
+	rate := float64(schedule.RateAt(now))
+	return &Limiter{rate: rate, tokens: rate, last: now, schedule: schedule, checked: now}
+}
+
+//Wait takes n bytes from the limiter, sleeping for as long as it takes to make up for them
+func (l *Limiter) Wait(n int) {
+	l.lock.Lock()
+	now := time.Now()
+	if l.schedule != nil && now.Sub(l.checked) >= time.Second {
+		l.checked = now
+		l.rate = float64(l.schedule.RateAt(now))
+	}
+	if l.rate <= 0 {
+		l.tokens = 0
+		l.last = now
+		l.lock.Unlock()
+		return
+	}
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.lock.Unlock()
+	time.Sleep(delay)
+}
+
+type reader struct {
+	source  io.Reader
+	limiter *Limiter
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.source.Read(p)
+	r.limiter.Wait(n)
+	return n, err
+}
+
+//Reader returns a reader that reads from source no faster than limiter allows.
+//If limiter is nil, source is returned as-is
+func Reader(source io.Reader, limiter *Limiter) io.Reader {
+	if limiter == nil {
+		return source
+	}
+	return &reader{source: source, limiter: limiter}
+}
+
+type writer struct {
+	dest    io.Writer
+	limiter *Limiter
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	n, err := w.dest.Write(p)
+	w.limiter.Wait(n)
+	return n, err
+}
+
+//Writer returns a writer that writes to dest no faster than limiter allows.
+//If limiter is nil, dest is returned as-is
+func Writer(dest io.Writer, limiter *Limiter) io.Writer {
+	if limiter == nil {
+		return dest
+	}
+	return &writer{dest: dest, limiter: limiter}
+}
+
+var units = []struct {
+	suffix string
+	size   int64
+}{
+	{"gb", 1024 * 1024 * 1024},
+	{"g", 1024 * 1024 * 1024},
+	{"mb", 1024 * 1024},
+	{"m", 1024 * 1024},
+	{"kb", 1024},
+	{"k", 1024},
+	{"b", 1},
+}
+
+//ParseRate parses a rate in bytes per second like "500KB", "10MB/s" or "1G". Units are
+//powers of 1024. An empty rate, or a rate of 0, means unlimited and returns 0
+func ParseRate(value string) (int64, error) {
+	rate := strings.ToLower(strings.TrimSpace(value))
+	rate = strings.TrimSuffix(rate, "/s")
+	if rate == "" {
+		return 0, nil
+	}
+	multiplier := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(rate, unit.suffix) {
+			multiplier = unit.size
+			rate = strings.TrimSpace(strings.TrimSuffix(rate, unit.suffix))
+			break
+		}
+	}
+	number, err := strconv.ParseFloat(rate, 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("Invalid rate '%s'", value)
+	}
+	return int64(number * float64(multiplier)), nil
+}
@@ -0,0 +1,77 @@
+package throttle_test
+
+import (
+	"bytes"
+	"github.com/tywkeene/autobd/throttle"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	var table = []struct {
+		Input string
+		Rate  int64
+		Valid bool
+	}{
+		{"", 0, true},
+		{"0", 0, true},
+		{"100", 100, true},
+		{"512KB", 512 * 1024, true},
+		{"10MB/s", 10 * 1024 * 1024, true},
+		{"1.5g", 1536 * 1024 * 1024, true},
+		{"fast", 0, false},
+		{"-1MB", 0, false},
+	}
+	for _, test := range table {
+		rate, err := throttle.ParseRate(test.Input)
+		if (err == nil) != test.Valid || rate != test.Rate {
+			t.Errorf("%s: got %d (%v), expected %d", test.Input, rate, err, test.Rate)
+		}
+	}
+}
+
+func TestReader(t *testing.T) {
+	const rate = 64 * 1024
+	limiter := throttle.NewLimiter(rate)
+	start := time.Now()
+	//The first second worth of bytes is a burst, the rest has to wait
+	data, err := ioutil.ReadAll(throttle.Reader(bytes.NewReader(make([]byte, rate*2)), limiter))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != rate*2 {
+		t.Fatalf("Read %d bytes, expected %d", len(data), rate*2)
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Errorf("Reading twice the rate took %s, expected about a second", elapsed)
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	schedule, err := throttle.ParseSchedule([]string{"mon-fri 09:00-17:00 10MB/s", "22:00-06:00 1MB", "unlimited"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var table = []struct {
+		Time string
+		Rate int64
+	}{
+		{"2017-03-06 10:30", 10 * 1024 * 1024}, //Monday, business hours
+		{"2017-03-06 17:00", 0},                //Monday, after hours
+		{"2017-03-11 10:30", 0},                //Saturday
+		{"2017-03-11 23:00", 1024 * 1024},      //Saturday night
+		{"2017-03-12 05:59", 1024 * 1024},      //Still saturday night
+	}
+	for _, test := range table {
+		at, _ := time.Parse("2006-01-02 15:04", test.Time)
+		if rate := schedule.RateAt(at); rate != test.Rate {
+			t.Errorf("%s: got %d, expected %d", test.Time, rate, test.Rate)
+		}
+	}
+	for _, invalid := range []string{"mon-fry 1MB", "09:00 1MB", "25:00-26:00 1MB", "mon 09:00-10:00 1MB extra"} {
+		if _, err := throttle.ParseSchedule([]string{invalid}); err == nil {
+			t.Errorf("%s should be invalid", invalid)
+		}
+	}
+}
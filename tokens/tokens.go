@@ -0,0 +1,172 @@
+//Package tokens manages the join tokens admins mint so nodes can enroll with a server
+package tokens
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/tywkeene/autobd/utils"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+//Token lets nodes enroll with the server until it expires or was used MaxUses times. Only its hash is
+//kept, the token itself is only known to whoever minted it
+type Token struct {
+	ID      string    `json:"id"`                //Identifies the token, and the nodes it enrolled, without revealing it
+	Hash    string    `json:"hash"`              //SHA256 of the token, hex encoded
+	Created time.Time `json:"created"`           //When the token was minted
+	Expires time.Time `json:"expires"`           //When the token can no longer be used
+	MaxUses int       `json:"max_uses"`          //How many nodes the token can enroll
+	Uses    int       `json:"uses"`              //How many nodes the token enrolled so far
+	Subtree string    `json:"subtree,omitempty"` //Only nodes syncing this directory or below it can enroll with the token
+	Labels  []string  `json:"labels,omitempty"`  //Given to the nodes the token enrolls
+}
+
+//Minted is a token that was just minted, along with the token itself
+type Minted struct {
+	Value string `json:"token"`
+	*Token
+}
+
+//The join tokens minted so far, indexed by hash
+var tokens = make(map[string]*Token)
+
+//Where tokens are saved, empty if they're only kept in memory
+var tokensFile string
+
+//For synchronized access to tokens
+var lock = sync.Mutex{}
+
+func hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+//Load reads the tokens saved in filename, and saves them there from now on
+func Load(filename string) error {
+	lock.Lock()
+	defer lock.Unlock()
+	tokensFile = filename
+	serial, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) == true {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var loaded map[string]*Token
+	if err := json.Unmarshal(serial, &loaded); err != nil {
+		return err
+	}
+	if loaded != nil {
+		tokens = loaded
+	}
+	return nil
+}
+
+//save writes tokens to the file set by Load(). Only the owner can read it
+func save() error {
+	if tokensFile == "" {
+		return nil
+	}
+	serial, err := json.MarshalIndent(&tokens, " ", " ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFile(tokensFile, bytes.NewReader(serial), nil)
+}
+
+//Mint returns a new token that enrolls up to maxUses nodes syncing subtree or below it, until validFor
+//has passed, and gives them labels. Labels are only recorded in the node list, they don't limit what
+//the nodes are served
+func Mint(validFor time.Duration, maxUses int, subtree string, labels []string) (*Minted, error) {
+	if validFor <= 0 || maxUses < 1 {
+		return nil, fmt.Errorf("Tokens have to be valid for some time, and enroll at least one node")
+	}
+	buffer := make([]byte, 32)
+	if _, err := rand.Read(buffer); err != nil {
+		return nil, err
+	}
+	value := hex.EncodeToString(buffer)
+	now := time.Now()
+	token := &Token{
+		Hash:    hash(value),
+		Created: now,
+		Expires: now.Add(validFor),
+		MaxUses: maxUses,
+		Subtree: subtree,
+		Labels:  labels,
+	}
+	token.ID = token.Hash[:12]
+	lock.Lock()
+	defer lock.Unlock()
+	tokens[token.Hash] = token
+	if err := save(); err != nil {
+		delete(tokens, token.Hash)
+		return nil, err
+	}
+	copied := *token
+	return &Minted{Value: value, Token: &copied}, nil
+}
+
+//Use counts a use of value by a node syncing target, and returns a copy of its token. Fails if value
+//isn't a token, or it expired, or it was already used as many times as it can be, or target is outside
+//of the token's subtree
+func Use(value string, target string) (*Token, error) {
+	lock.Lock()
+	defer lock.Unlock()
+	token, ok := tokens[hash(value)]
+	if ok == false || value == "" {
+		return nil, fmt.Errorf("Invalid join token")
+	}
+	if time.Now().After(token.Expires) == true {
+		return nil, fmt.Errorf("Join token %s expired", token.ID)
+	}
+	if token.Uses >= token.MaxUses {
+		return nil, fmt.Errorf("Join token %s was used up", token.ID)
+	}
+	if token.Subtree != "" {
+		if _, err := utils.ConfinePath(token.Subtree, target); err != nil {
+			return nil, fmt.Errorf("Target directory is outside of the directory join token %s is limited to", token.ID)
+		}
+	}
+	token.Uses++
+	if err := save(); err != nil {
+		token.Uses--
+		return nil, err
+	}
+	copied := *token
+	return &copied, nil
+}
+
+//List returns copies of every token, oldest first
+func List() []*Token {
+	lock.Lock()
+	defer lock.Unlock()
+	list := make([]*Token, 0, len(tokens))
+	for _, token := range tokens {
+		copied := *token
+		list = append(list, &copied)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return list
+}
+
+//Revoke removes the token with id, so it can't be used anymore. Returns false if there's no such token
+func Revoke(id string) (bool, error) {
+	lock.Lock()
+	defer lock.Unlock()
+	for key, token := range tokens {
+		if token.ID == id {
+			delete(tokens, key)
+			return true, save()
+		}
+	}
+	return false, nil
+}
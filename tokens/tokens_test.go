@@ -0,0 +1,78 @@
+package tokens_test
+
+import (
+	"github.com/tywkeene/autobd/tokens"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+//Ensure tokens can only be used as many times as they were minted for, and only before they expire
+func TestUse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	//Subtrees are relative to the served directory, the server's working directory
+	cwd, _ := os.Getwd()
+	defer os.Chdir(cwd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir("photos", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := tokens.Load(".tokens"); err != nil {
+		t.Fatal(err)
+	}
+
+	twice, err := tokens.Mint(time.Hour, 2, "", []string{"eu"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		token, err := tokens.Use(twice.Value, "./")
+		if err != nil {
+			t.Fatalf("Use %d refused: %s", i+1, err.Error())
+		}
+		if token.ID != twice.ID || token.Uses != i+1 || len(token.Labels) != 1 {
+			t.Errorf("Got token %+v after %d uses", token, i+1)
+		}
+	}
+	if _, err := tokens.Use(twice.Value, "./"); err == nil {
+		t.Errorf("Used up token accepted")
+	}
+
+	expired, _ := tokens.Mint(time.Nanosecond, 1, "", nil)
+	time.Sleep(time.Millisecond)
+	if _, err := tokens.Use(expired.Value, "./"); err == nil {
+		t.Errorf("Expired token accepted")
+	}
+	if _, err := tokens.Use("", "./"); err == nil {
+		t.Errorf("Empty token accepted")
+	}
+
+	scoped, _ := tokens.Mint(time.Hour, 2, "photos", nil)
+	if _, err := tokens.Use(scoped.Value, "./"); err == nil {
+		t.Errorf("Token used outside of its subtree")
+	}
+	if _, err := tokens.Use(scoped.Value, "./photos/2017"); err != nil {
+		t.Errorf("Token refused inside of its subtree: %s", err.Error())
+	}
+
+	//Tokens are saved, and revoked ones can't be used
+	if err := tokens.Load(".tokens"); err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens.List()) != 3 {
+		t.Errorf("Got %d tokens after loading them again, expected 3", len(tokens.List()))
+	}
+	if revoked, err := tokens.Revoke(scoped.ID); revoked == false || err != nil {
+		t.Errorf("Token not revoked: %v", err)
+	}
+	if _, err := tokens.Use(scoped.Value, "photos"); err == nil {
+		t.Errorf("Revoked token accepted")
+	}
+}
@@ -2,13 +2,18 @@ package utils
 
 import (
 	"encoding/json"
+	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/tywkeene/autobd/options"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"path"
+	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -85,16 +90,196 @@ func HandleError(err error, action int) bool {
 	return (err != nil)
 }
 
-func WriteFile(filename string, source io.Reader) error {
-	writer, err := os.Create(filename)
+//TempFile creates a temporary file in the same directory as filename, so it can later be
+//renamed over filename with CommitFile
+func TempFile(filename string) (*os.File, error) {
+	return ioutil.TempFile(path.Dir(filename), "."+path.Base(filename)+".autobd-")
+}
+
+//IsTempFile reports whether filename is one of the temporary files autobd writes while
+//transferring files, which should never be indexed or removed by anything but autobd itself
+func IsTempFile(filename string) bool {
+	base := path.Base(filename)
+	return strings.HasPrefix(base, ".") && strings.Contains(base, ".autobd-")
+}
+
+//CommitFile syncs the file at tempPath to disk, renames it over filename, and syncs the
+//directory so the rename itself survives a crash
+func CommitFile(tempPath string, filename string) error {
+	file, err := os.OpenFile(tempPath, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tempPath, filename); err != nil {
+		return err
+	}
+	dir, err := os.Open(path.Dir(filename))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+//WriteFile writes source to filename atomically. The content goes to a temporary file first,
+//which is only renamed over filename once it has been completely written and synced to disk,
+//so a crash or short read never leaves a truncated filename behind.
+//If verify is not nil, it's called with the path of the temporary file before it's renamed,
+//and filename is left untouched if it returns an error
+func WriteFile(filename string, source io.Reader, verify func(tempPath string) error) error {
+	temp, err := TempFile(filename)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	_, err = io.Copy(temp, source)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if verify != nil {
+		if err := verify(temp.Name()); err != nil {
+			return err
+		}
+	}
+	return CommitFile(temp.Name(), filename)
+}
+
+//MapOwner translates a server's uid and gid into the node's, using the uid_map and gid_map
+//tables in the node configuration. Ids without an entry are returned as-is
+func MapOwner(uid int, gid int) (int, int) {
+	if mapped, ok := options.Config.NodeConfig.UIDMap[strconv.Itoa(uid)]; ok == true {
+		uid = mapped
+	}
+	if mapped, ok := options.Config.NodeConfig.GIDMap[strconv.Itoa(gid)]; ok == true {
+		gid = mapped
+	}
+	return uid, gid
+}
+
+//CanChown reports whether the node should set the ownership of the files it syncs,
+//which requires running as root
+func CanChown() bool {
+	return options.Config.NodeConfig.PreserveOwnership == true && os.Geteuid() == 0
+}
+
+//SetMetadata applies a server file's mode and modification time, and its ownership if
+//CanChown(), to the file at name
+func SetMetadata(name string, mode os.FileMode, modTime time.Time, uid int, gid int) error {
+	if CanChown() == true {
+		uid, gid = MapOwner(uid, gid)
+		//Changing the owner can clear the setuid and setgid bits, so do it before chmod
+		if err := os.Lchown(name, uid, gid); err != nil {
+			return err
+		}
+	}
+	if err := os.Chmod(name, mode); err != nil {
+		return err
+	}
+	return os.Chtimes(name, modTime, modTime)
+}
+
+//LinkEscapes reports whether target, the target of the symbolic link at name, points
+//outside of the tree name is in. Absolute targets always count as outside
+func LinkEscapes(name string, target string) bool {
+	if path.IsAbs(target) == true {
+		return true
+	}
+	resolved := path.Clean(path.Join(path.Dir(name), target))
+	return resolved == ".." || strings.HasPrefix(resolved, "../")
+}
+
+//isInside reports whether the absolute path name is dir or something below it
+func isInside(name string, dir string) bool {
+	return name == dir || strings.HasPrefix(name, strings.TrimSuffix(dir, "/")+"/")
+}
+
+//resolve returns the absolute path of name with all symbolic links resolved
+func resolve(name string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(name)
 	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(resolved)
+}
+
+//ConfinePath checks that name, a path relative to the working directory, stays inside of root.
+//Absolute paths, paths that climb out of root with "..", and paths whose parent directories
+//lead outside of root through a symbolic link are rejected. The last element of name isn't
+//resolved, since symbolic links are synced as links. A root of "/" is the working directory,
+//like everywhere else in the API. Returns the cleaned name
+func ConfinePath(root string, name string) (string, error) {
+	if name == "" || path.IsAbs(name) == true {
+		return "", fmt.Errorf("Path '%s' is not relative to the tree", name)
+	}
+	root = path.Clean(root)
+	if root == "/" {
+		root = "."
+	}
+	cleaned := path.Clean(name)
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") ||
+		(root != "." && cleaned != root && strings.HasPrefix(cleaned, root+"/") == false) {
+		return "", fmt.Errorf("Path '%s' is outside of '%s'", name, root)
+	}
+	if cleaned == root {
+		return cleaned, nil
+	}
+	realRoot, err := resolve(root)
+	if err != nil {
+		return "", err
+	}
+	//Find the closest parent directory that exists, and make sure it really is inside of root
+	for parent := path.Dir(cleaned); ; parent = path.Dir(parent) {
+		realParent, err := resolve(parent)
+		if os.IsNotExist(err) == true {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		if isInside(realParent, realRoot) == false {
+			return "", fmt.Errorf("Path '%s' leads outside of '%s' through a symbolic link", name, root)
+		}
+		return cleaned, nil
+	}
+}
+
+//replaceWith creates something at a temporary name next to name with create, then renames it over name
+func replaceWith(name string, create func(tempPath string) error) error {
+	tempPath := path.Join(path.Dir(name), "."+path.Base(name)+".autobd-link")
+	os.Remove(tempPath)
+	if err := create(tempPath); err != nil {
+		return err
+	}
+	if err := os.Rename(tempPath, name); err != nil {
+		os.Remove(tempPath)
 		return err
 	}
-	defer writer.Close()
-	io.Copy(writer, source)
 	return nil
 }
 
+//Symlink atomically replaces whatever is at name with a symbolic link to target
+func Symlink(target string, name string) error {
+	return replaceWith(name, func(tempPath string) error {
+		return os.Symlink(target, tempPath)
+	})
+}
+
+//Link atomically replaces whatever is at name with a hard link to existing
+func Link(existing string, name string) error {
+	return replaceWith(name, func(tempPath string) error {
+		return os.Link(existing, tempPath)
+	})
+}
+
 // This is neat: https://coderwall.com/p/cp5fya/measuring-execution-time-in-go
 func TimeTrack(start time.Time, name string) {
 	if options.Config.LogTimeTrack == true {